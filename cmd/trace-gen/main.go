@@ -0,0 +1,251 @@
+/*
+Copyright 2018 Google LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Command trace-gen generates a wrapper for a Go interface that traces
+the entry into and exit from each of its methods with
+trace.TraceEnter. Since Go cannot create method sets at run time, this
+is the way to instrument all the methods of a type at once.
+
+Usage:
+
+	trace-gen -source store.go -interface Store -trace_import trace > traced_store.go
+
+The generated file is in the same package as the interface, and
+defines a function NewTracedStore that wraps any Store. The
+-trace_import flag is the import path of the trace package, which
+defaults to "trace", the path it has when installed under
+$GOPATH/src/trace.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	source := flag.String("source", "", "Go source file declaring the interface")
+	iface := flag.String("interface", "", "name of the interface to wrap")
+	traceImport := flag.String("trace_import", "trace", "import path of the trace package")
+	output := flag.String("o", "", "output file (default standard output)")
+	flag.Parse()
+	if *source == "" || *iface == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := ioutil.ReadFile(*source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	generated, err := generate(*source, src, *iface, *traceImport)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		os.Stdout.Write(generated)
+		return
+	}
+	if err := ioutil.WriteFile(*output, generated, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate returns the source code of a tracing wrapper for the
+// interface `iface` declared in `src`, which was read from `filename`.
+func generate(filename string, src []byte, iface, traceImport string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	methods, err := findInterface(file, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := "traced" + iface
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by trace-gen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", file.Name.Name)
+	fmt.Fprintf(&buf, "import (\n")
+	for _, path := range usedImports(file, methods) {
+		fmt.Fprintf(&buf, "\t%s\n", path)
+	}
+	fmt.Fprintf(&buf, "\n\t%q\n)\n\n", traceImport)
+	fmt.Fprintf(&buf, "// %s wraps a %s, tracing the entry into and exit from each method.\n", wrapper, iface)
+	fmt.Fprintf(&buf, "type %s struct {\n\tinner %s\n}\n\n", wrapper, iface)
+	fmt.Fprintf(&buf, "// NewTraced%s returns a %s that traces all calls to `inner`.\n", iface, iface)
+	fmt.Fprintf(&buf, "func NewTraced%s(inner %s) %s {\n\treturn %s{inner: inner}\n}\n", iface, iface, iface, wrapper)
+	for _, method := range methods {
+		fmt.Fprintln(&buf)
+		if err := writeMethod(&buf, fset, iface, wrapper, method); err != nil {
+			return nil, err
+		}
+	}
+	return format.Source(buf.Bytes())
+}
+
+// findInterface returns the methods of the interface `name` declared
+// in `file`.
+func findInterface(file *ast.File, name string) ([]*ast.Field, error) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if typeSpec.Name.Name != name {
+				continue
+			}
+			ifaceType, ok := typeSpec.Type.(*ast.InterfaceType)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an interface", name)
+			}
+			for _, method := range ifaceType.Methods.List {
+				if len(method.Names) == 0 {
+					return nil, fmt.Errorf("%s embeds another interface, which is not supported", name)
+				}
+			}
+			return ifaceType.Methods.List, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found", name)
+}
+
+// usedImports returns the import specs of `file` that are referenced
+// by the signatures of `methods`, which the generated code needs too.
+func usedImports(file *ast.File, methods []*ast.Field) []string {
+	used := map[string]bool{}
+	for _, method := range methods {
+		ast.Inspect(method.Type, func(node ast.Node) bool {
+			if sel, ok := node.(*ast.SelectorExpr); ok {
+				if ident, ok := sel.X.(*ast.Ident); ok {
+					used[ident.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	var specs []string
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		spec := imp.Path.Value
+		if imp.Name != nil {
+			name = imp.Name.Name
+			spec = name + " " + spec
+		}
+		if used[name] {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// writeMethod writes to `buf` the implementation of `method` by
+// `wrapper`, which traces the call and delegates it to the wrapped
+// `iface`.
+func writeMethod(buf *bytes.Buffer, fset *token.FileSet, iface, wrapper string, method *ast.Field) error {
+	name := method.Names[0].Name
+	funcType := method.Type.(*ast.FuncType)
+
+	var params, args []string
+	for idx, param := range fieldList(funcType.Params) {
+		arg := fmt.Sprintf("p%d", idx)
+		typ, err := render(fset, param)
+		if err != nil {
+			return err
+		}
+		params = append(params, arg+" "+typ)
+		if _, variadic := param.(*ast.Ellipsis); variadic {
+			arg += "..."
+		}
+		args = append(args, arg)
+	}
+	var results, values, verbs []string
+	for idx, result := range fieldList(funcType.Results) {
+		typ, err := render(fset, result)
+		if err != nil {
+			return err
+		}
+		results = append(results, typ)
+		values = append(values, fmt.Sprintf("r%d", idx))
+		verbs = append(verbs, "%v")
+	}
+
+	signature := fmt.Sprintf("%s(%s)", name, strings.Join(params, ", "))
+	switch len(results) {
+	case 0:
+	case 1:
+		signature += " " + results[0]
+	default:
+		signature += " (" + strings.Join(results, ", ") + ")"
+	}
+	call := fmt.Sprintf("w.inner.%s(%s)", name, strings.Join(args, ", "))
+
+	fmt.Fprintf(buf, "func (w %s) %s {\n", wrapper, signature)
+	fmt.Fprintf(buf, "\tdone := trace.TraceEnter(%q)\n", iface+"."+name)
+	if len(results) == 0 {
+		fmt.Fprintf(buf, "\t%s\n\tdone()\n}\n", call)
+		return nil
+	}
+	fmt.Fprintf(buf, "\t%s := %s\n", strings.Join(values, ", "), call)
+	fmt.Fprintf(buf, "\tdone(%q, %s)\n", "-> "+strings.Join(verbs, ", "), strings.Join(values, ", "))
+	fmt.Fprintf(buf, "\treturn %s\n}\n", strings.Join(values, ", "))
+	return nil
+}
+
+// fieldList returns the type of each parameter or result in `fields`,
+// repeating the type of grouped names such as "a, b int".
+func fieldList(fields *ast.FieldList) []ast.Expr {
+	if fields == nil {
+		return nil
+	}
+	var types []ast.Expr
+	for _, field := range fields.List {
+		count := len(field.Names)
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			types = append(types, field.Type)
+		}
+	}
+	return types
+}
+
+// render returns the source code of `expr`.
+func render(fset *token.FileSet, expr ast.Expr) (string, error) {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, expr); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
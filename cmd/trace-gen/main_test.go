@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Google LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGenerateGolden(t *testing.T) {
+	source := filepath.Join("testdata", "store.go")
+	golden := filepath.Join("testdata", "store.golden")
+	src, err := ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := generate(source, src, "Store", "trace")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("generated code differs from %s; got:\n%s", golden, got)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	src := []byte(`package p
+
+type Base interface{ M() }
+type Embeds interface{ Base }
+type NotInterface struct{}
+`)
+	for _, name := range []string{"Embeds", "NotInterface", "Missing"} {
+		if _, err := generate("p.go", src, name, "trace"); err == nil {
+			t.Errorf("generate(%s): got no error", name)
+		}
+	}
+}
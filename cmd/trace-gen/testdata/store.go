@@ -0,0 +1,19 @@
+package store
+
+import (
+	"context"
+	"errors"
+	ioalias "io"
+)
+
+// ErrNotFound is never used by the wrapper, so its import is dropped.
+var ErrNotFound = errors.New("not found")
+
+// Store is a sample interface to wrap.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Keys(prefixes ...string) []string
+	Export(w ioalias.Writer) (n int64, err error)
+	Close()
+}
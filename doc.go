@@ -39,15 +39,24 @@ interesting state of your program:
 
 You should turn on tracing before the point in your program where you
 want to trace. If you want to trace a package init() function, turn it
-on there. This function call is idempotent. It is merely a shorthand
-for setting Global.On:
+on there. This function call is idempotent. Besides turning Global on,
+it marks the start and end of each tracing session in the output:
 
   trace.On(true)
 
+Until then, the first call to trace.Trace() prints a hint to stderr
+that tracing is off, unless the TRACE_NOHINT environment variable is
+set or trace.HintWhenOff is cleared.
+
 You may also turn off tracing at any point you wish:
 
   trace.On(false)
 
+Use trace.On(), or Tracer.SetOn() for other Tracers, rather than
+setting the deprecated On field, which is ignored once tracing has
+been turned on or off this way and is unsafe to change while other
+goroutines are tracing.
+
 In fact, you may change many of the seetings of an active Tracer
 object by modifying them directly. For example, to make global tracer
 only trace the last reported goroutine, use
@@ -56,7 +65,9 @@ only trace the last reported goroutine, use
 
 While in most cases you'll want to use the trace.Global logger
 (accessible directly and through the trace.Trace function), you can
-also create custom Tracer objects and use them via Tracer.Trace().
+also create custom Tracer objects and use them via Tracer.Trace(),
+or make one the global tracer with trace.SetGlobal(), which unlike
+assigning trace.Global is safe while other goroutines are tracing.
 
 Tracer is concurrency-safe. When Trace() is called from a different
 goroutine than its previous call, it prints a warning about a
@@ -55,7 +55,7 @@ func c(n string) {
 }
 
 func Example() {
-	trace.Global.On = true
+	trace.On(true)
 	trace.Trace("Start")
 	c("one")
 
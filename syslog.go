@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/*
+Copyright 2018 Google LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trace
+
+import (
+	"log"
+	"log/syslog"
+)
+
+// NewSyslogLogger returns a Logger that writes to the system log with
+// the given `tag` and `priority`, so that daemons without a terminal
+// can be traced, as in
+//
+//	out, err := trace.NewSyslogLogger("mydaemon", syslog.LOG_DEBUG|syslog.LOG_DAEMON)
+//	if err == nil {
+//		trace.Global.Out = out
+//	}
+//
+// If the connection to the system log drops, it is re-established on
+// the next write.
+func NewSyslogLogger(tag string, priority syslog.Priority) (Logger, error) {
+	return dialSyslogLogger("", "", tag, priority)
+}
+
+// dialSyslogLogger is like NewSyslogLogger, but connects to the syslog
+// server at `raddr` on `network`, or to the local one if both are
+// empty.
+func dialSyslogLogger(network, raddr, tag string, priority syslog.Priority) (Logger, error) {
+	writer, err := syslog.Dial(network, raddr, priority, tag)
+	if err != nil {
+		return nil, err
+	}
+	// syslog.Writer reconnects by itself when a write fails.
+	return log.New(writer, "", 0), nil
+}
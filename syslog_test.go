@@ -0,0 +1,58 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/*
+Copyright 2018 Google LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trace
+
+import (
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogLogger(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen for syslog messages: %v", err)
+	}
+	defer server.Close()
+
+	out, err := dialSyslogLogger("udp", server.LocalAddr().String(), "tracetest", syslog.LOG_DEBUG|syslog.LOG_USER)
+	if err != nil {
+		t.Fatalf("dialSyslogLogger: %v", err)
+	}
+	tr := newTestTracer(out)
+	tr.Trace(0, "to syslog")
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	var received []string
+	for !strings.Contains(strings.Join(received, "\n"), "to syslog") {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got messages %q, then %v; want one with the traced line", received, err)
+		}
+		received = append(received, string(buf[:n]))
+	}
+	last := received[len(received)-1]
+	if !strings.HasPrefix(last, "<15>") || !strings.Contains(last, "tracetest[") {
+		t.Errorf("got message %q, want priority 15 and tag tracetest", last)
+	}
+}
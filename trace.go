@@ -17,14 +17,29 @@ limitations under the License.
 package trace
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Logger defines the output functionality needed by Tracer. Note that
@@ -34,6 +49,26 @@ type Logger interface {
 	Println(v ...interface{})
 }
 
+// LoggerFunc adapts a function receiving each line of output to the
+// Logger interface, to bridge a Tracer to other systems without this
+// package depending on them. For example, to record the lines as
+// events of the current OpenTelemetry span:
+//
+//	span := oteltrace.SpanFromContext(ctx)
+//	tr.Out = trace.LoggerFunc(func(line string) { span.AddEvent(line) })
+type LoggerFunc func(line string)
+
+// Printf calls `f` with the formatted line.
+func (f LoggerFunc) Printf(format string, v ...interface{}) {
+	f(fmt.Sprintf(format, v...))
+}
+
+// Println calls `f` with the line formatted like fmt.Println(), without
+// the trailing newline.
+func (f LoggerFunc) Println(v ...interface{}) {
+	f(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
 type FrameInfo struct {
 	runtime.Frame
 
@@ -43,6 +78,16 @@ type FrameInfo struct {
 	// recorded at the same time, even though they were actually
 	// entered at different times.
 	TimeRecorded time.Time
+
+	// Message is the message logged by the call to Trace() that
+	// recorded this frame as the top of the stack. It is only set
+	// if the Tracer's FrameMessages option is on.
+	Message string
+
+	// Inlined is true if the call to this frame's function was
+	// inlined by the compiler into its caller, the next frame down
+	// the stack, with which it shares its PC.
+	Inlined bool
 }
 
 // Copy returns a deep copy of `fr`.
@@ -50,7 +95,7 @@ func (fr *FrameInfo) Copy() *FrameInfo {
 	if fr == nil {
 		return nil
 	}
-	return &FrameInfo{Frame: fr.Frame, TimeRecorded: fr.TimeRecorded}
+	return &FrameInfo{Frame: fr.Frame, TimeRecorded: fr.TimeRecorded, Message: fr.Message, Inlined: fr.Inlined}
 }
 
 // Equal returns true if `fr` is identical to `other`.
@@ -63,9 +108,62 @@ func (fr *FrameInfo) Same(other *FrameInfo) bool {
 	return fr.Frame == other.Frame
 }
 
+// frameInfoJSON is the JSON representation of a FrameInfo.
+type frameInfoJSON struct {
+	Function     string
+	File         string
+	Line         int
+	PC           uintptr
+	Entry        uintptr
+	TimeRecorded time.Time
+	Message      string `json:",omitempty"`
+	Inlined      bool   `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Unlike the default encoding,
+// it flattens the embedded runtime.Frame and omits its unexported
+// fields, so that the result can be decoded by UnmarshalJSON.
+func (fr FrameInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(frameInfoJSON{
+		Function:     fr.Function,
+		File:         fr.File,
+		Line:         fr.Line,
+		PC:           fr.PC,
+		Entry:        fr.Entry,
+		TimeRecorded: fr.TimeRecorded,
+		Message:      fr.Message,
+		Inlined:      fr.Inlined,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (fr *FrameInfo) UnmarshalJSON(data []byte) error {
+	var decoded frameInfoJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*fr = FrameInfo{
+		Frame: runtime.Frame{
+			Function: decoded.Function,
+			File:     decoded.File,
+			Line:     decoded.Line,
+			PC:       decoded.PC,
+			Entry:    decoded.Entry,
+		},
+		TimeRecorded: decoded.TimeRecorded,
+		Message:      decoded.Message,
+		Inlined:      decoded.Inlined,
+	}
+	return nil
+}
+
 // from creates a *FrameInfo from the provided `frame` and `timeStamp`.
 func from(frame runtime.Frame, timeStamp time.Time) *FrameInfo {
-	return &FrameInfo{Frame: frame, TimeRecorded: timeStamp}
+	// The runtime only provides a Func for the outermost function
+	// of each physical frame, so a named frame without one was
+	// inlined.
+	inlined := frame.Func == nil && frame.Function != ""
+	return &FrameInfo{Frame: frame, TimeRecorded: timeStamp, Inlined: inlined}
 }
 
 type GoroutineInfo struct {
@@ -88,9 +186,52 @@ type GoroutineInfo struct {
 	// frames
 	TopMessage string
 
+	// State is the runtime state of this goroutine (eg "chan
+	// receive"), as of the last goroutine switch. It is only
+	// captured if the Tracer's ShowGoroutineState option is on.
+	State string
+
+	// CreatedBy describes the function, and its source location,
+	// that started this goroutine. It is only captured if the
+	// Tracer's PrintCreationStack option is on.
+	CreatedBy string
+
+	// Fingerprint is a short hash of the ID and first recorded stack
+	// of this goroutine, computed when it is first traced. Since
+	// goroutine IDs may be reused, it distinguishes different
+	// goroutines that had the same ID in separate Tracers or runs.
+	Fingerprint string
+
+	// Token is the correlation token, if any, passed on the last
+	// call to TraceToken() on this goroutine.
+	Token Token
+
+	// Key is the key, if any, passed on the last call to TraceKey()
+	// on this goroutine.
+	Key string
+
+	// FirstRecorded and LastRecorded are the times of the first and
+	// last calls to Trace() on this goroutine.
+	FirstRecorded, LastRecorded time.Time
+
+	// FramesRecorded is the number of new frames recorded over all
+	// the calls to Trace() on this goroutine.
+	FramesRecorded int
+
+	// MaxDepth is the largest number of frames ever recorded on the
+	// stack of this goroutine.
+	MaxDepth int
+
 	// History holds all the logging entries ever written for this
 	// goroutine.
 	History []string
+
+	// historySeqs and historyKeys hold, for each line of History, its
+	// position among the lines recorded by the Tracer, which orders
+	// the merged History of all goroutines, and the key passed to
+	// TraceKey(), if any.
+	historySeqs []int
+	historyKeys []string
 }
 
 // Copy returns a deep copy of `gi`.
@@ -99,10 +240,19 @@ func (gi *GoroutineInfo) Copy() *GoroutineInfo {
 		return nil
 	}
 	newGi := &GoroutineInfo{
-		ID:         gi.ID,
-		Frames:     make([]*FrameInfo, len(gi.Frames)),
-		TopMessage: gi.TopMessage,
-		History:    make([]string, len(gi.History)),
+		ID:             gi.ID,
+		Frames:         make([]*FrameInfo, len(gi.Frames)),
+		TopMessage:     gi.TopMessage,
+		State:          gi.State,
+		CreatedBy:      gi.CreatedBy,
+		Fingerprint:    gi.Fingerprint,
+		Token:          gi.Token,
+		Key:            gi.Key,
+		FirstRecorded:  gi.FirstRecorded,
+		LastRecorded:   gi.LastRecorded,
+		FramesRecorded: gi.FramesRecorded,
+		MaxDepth:       gi.MaxDepth,
+		History:        make([]string, len(gi.History)),
 	}
 	for idx, frame := range gi.Frames {
 		newGi.Frames[idx] = frame.Copy()
@@ -113,12 +263,127 @@ func (gi *GoroutineInfo) Copy() *GoroutineInfo {
 	return newGi
 }
 
+// minMarkerWidth is the minimum width of the markers surrounding the
+// goroutine switch banner.
+const minMarkerWidth = 10
+
+// defaultGoroutineIDWidth is the width of goroutine IDs in the output
+// if Tracer.GoroutineIDWidth is not set.
+const defaultGoroutineIDWidth = 3
+
+// maxCachedIndents is the maximum number of indentation levels cached
+// by a Tracer.
+const maxCachedIndents = 64
+
+// defaultDurationPrecision is the number of significant digits used
+// when printing durations if Tracer.DurationPrecision is not set.
+const defaultDurationPrecision = 2
+
+// maxStatsFunctions is the maximum number of functions counted
+// individually in Stats.Functions; further functions are counted
+// under otherFunctions, to bound the cardinality of exported metrics.
+const maxStatsFunctions = 100
+
+// otherFunctions is the key in Stats.Functions that counts the traces
+// of functions beyond maxStatsFunctions.
+const otherFunctions = "(other)"
+
+// maxCachedSourceFiles is the maximum number of source files whose
+// lines are cached by a Tracer for ShowSource. When it is exceeded,
+// the cache is cleared.
+const maxCachedSourceFiles = 32
+
+// maxSourceFileSize is the size in bytes beyond which source files
+// are not read for ShowSource.
+const maxSourceFileSize = 1 << 20
+
+// maxErrorChainLength is the maximum length of each wrapped error
+// printed by TraceErrChain.
+const maxErrorChainLength = 200
+
+// Alignment specifies the justification of a column of output.
+type Alignment int
+
+const (
+	// AlignRight pads the column on the left.
+	AlignRight Alignment = iota
+
+	// AlignLeft pads the column on the right.
+	AlignLeft
+)
+
+// String renders the stack of `gi` in the same layout as Tracer
+// output, one frame per line with the bottom of the stack first: the
+// source location, the function indented according to its depth, and
+// the message on the top frame. Time stamps and callouts are omitted.
+func (gi *GoroutineInfo) String() string {
+	if gi == nil {
+		return ""
+	}
+	var res strings.Builder
+	fmt.Fprintf(&res, "goroutine %d:\n", gi.ID)
+	for idx := len(gi.Frames) - 1; idx >= 0; idx-- {
+		frame := gi.Frames[idx]
+		var message string
+		if idx == 0 {
+			message = gi.TopMessage
+		}
+		level := len(gi.Frames) - idx - 1
+		line := fmt.Sprintf("%s:%d %s%s() %s", frame.File, frame.Line, strings.Repeat("  ", level), frame.Function, message)
+		res.WriteString(strings.TrimSpace(line))
+		res.WriteString("\n")
+	}
+	return res.String()
+}
+
+// TimePrecision specifies the precision of the time stamps printed by
+// a Tracer.
+type TimePrecision int
+
+const (
+	// TimeDefault prints time stamps to 10 nanoseconds.
+	TimeDefault TimePrecision = iota
+
+	// TimeSeconds prints time stamps to the second.
+	TimeSeconds
+
+	// TimeMillis prints time stamps to the millisecond.
+	TimeMillis
+
+	// TimeMicros prints time stamps to the microsecond.
+	TimeMicros
+
+	// TimeNanos prints time stamps to the nanosecond.
+	TimeNanos
+)
+
+// layout returns the time layout for `precision`.
+func (precision TimePrecision) layout() string {
+	switch precision {
+	case TimeSeconds:
+		return "2006-01-02 15:04:05"
+	case TimeMillis:
+		return "2006-01-02 15:04:05.000"
+	case TimeMicros:
+		return "2006-01-02 15:04:05.000000"
+	case TimeNanos:
+		return "2006-01-02 15:04:05.000000000"
+	}
+	return "2006-01-02 15:04:05.00000000"
+}
+
 // Tracer records and echoes the call stack when Trace() is
 // invoked. The public parameters configure how Tracer operates, and
 // may be changed at run time, in which case they take effect on the
-// next call to Trace().
+// next call to Trace(). While other goroutines may be tracing, they
+// must be changed via Configure() to avoid data races.
 type Tracer struct {
-	// On determines whether the Tracer is active or not.
+	// On determines whether the Tracer is active or not, until
+	// SetOn() is first called, either directly or via Enable() or the
+	// package-level On(): from then on, On is ignored.
+	//
+	// Deprecated: Use SetOn() and IsOn(), which unlike On are safe
+	// to use while other goroutines are tracing.
 	On bool
 
 	// Out receives the output of the Trace() calls.
@@ -127,11 +392,19 @@ type Tracer struct {
 	// Capacity holds the maximum stack size we can accomodate.
 	Capacity int
 
-	// SourceLength holds the maxium displayed length,
-	// right-justified, of the string specifying the source code
-	// file name and line number. The
+	// SourceLength holds the maxium displayed length, justified
+	// according to SourceAlign, of the string specifying the source code
+	// file name and line number. If it is zero or negative, the column
+	// is omitted. Longer file names lose their leading directories,
+	// replaced by "…", but the line number is always shown, even if
+	// the column then exceeds SourceLength.
 	SourceLength int
 
+	// SourceAlign determines how the file name and line number are
+	// justified within SourceLength when they are shorter than
+	// it. The default is AlignRight.
+	SourceAlign Alignment
+
 	// LockGoroutine causes Trace() to only record and emit output
 	// for the current (ie last invoking) goroutine.
 	LockGoroutine bool
@@ -144,9 +417,26 @@ type Tracer struct {
 	// frames (if enabled via the OnGoroutinePrint* options).
 	OmitTime bool
 
+	// ReserveTimeColumn causes the time stamp column to be filled
+	// with blanks when OmitTime is set, so that the remaining columns
+	// stay aligned with lines printed with time stamps, for example
+	// when OmitTime is toggled in the middle of a session.
+	ReserveTimeColumn bool
+
+	// TimePrecision selects the precision of the printed time
+	// stamps.
+	TimePrecision TimePrecision
+
+	// EpochTime causes time stamps to be printed as the number of
+	// seconds since the Unix epoch, with a nanosecond fraction (eg
+	// "1514862245.123456789"), which is easier to correlate with the
+	// logs of other systems. It overrides TimePrecision.
+	EpochTime bool
+
 	// ClockFn is the function that will return the time used to
 	// record when Trace() calls were invoked. If not specified,
-	// time.Now will be used.
+	// time.Now will be used. FixedClock provides a deterministic
+	// clock for tests.
 	ClockFn func() time.Time
 
 	// OnGoroutineSwitchPrintCurrentStack prints out the current
@@ -160,179 +450,2635 @@ type Tracer struct {
 	// different goroutine.
 	OnGoroutineSwitchPrintStackHistory bool
 
+	// FailFn, if set, is called with the failure message whenever
+	// an Assert() fails. This makes it easy to integrate with
+	// testing.T.Fatalf.
+	FailFn func(msg string)
+
+	// DedupeConsecutive suppresses output lines identical to the
+	// line emitted immediately before them. The number of
+	// suppressed lines is reported just before the next distinct
+	// line is emitted.
+	DedupeConsecutive bool
+
+	// MarkerWidth is the width of the dashed markers surrounding
+	// the goroutine switch banner. If it is not positive,
+	// SourceLength is used instead. Either way, the markers are at
+	// least minMarkerWidth wide so the banner is always visible.
+	MarkerWidth int
+
+	// DurationPrecision is the number of significant digits used
+	// when printing durations. If it is not positive,
+	// defaultDurationPrecision is used.
+	DurationPrecision int
+
+	// FallbackOnPanic protects the traced program from a Logger in
+	// Out that panics (for example, because it writes to a closed
+	// file). When set, such a panic is recovered, reported once,
+	// and Out is replaced by a Logger writing to stderr.
+	FallbackOnPanic bool
+
+	// GoroutineIDWidth is the minimum width of goroutine IDs in the
+	// output. Increase it to keep columns aligned in programs
+	// with many goroutines. If it is not positive,
+	// defaultGoroutineIDWidth is used.
+	GoroutineIDWidth int
+
+	// ShowFrameAge causes each printed frame to be annotated with
+	// the time elapsed since it was first recorded, which shows
+	// how long execution has been inside each level of the stack.
+	ShowFrameAge bool
+
+	// SilentCapture causes Trace() to record frames and History as
+	// usual without writing anything to Out. The recorded output
+	// can be written later via DumpAll(). Unlike turning the
+	// Tracer off, this preserves the full picture for post-mortem
+	// debugging.
+	SilentCapture bool
+
+	// FrameMessages causes the message of each Trace() call to be
+	// stored in the top frame it recorded, so that whenever that
+	// frame is printed again (for example, on a goroutine switch)
+	// it carries its own message. By default, only the current top
+	// of the stack is printed with a message.
+	FrameMessages bool
+
+	// HotThreshold, if positive, causes Trace() to emit a hint
+	// whenever the function at the top of the current stack is
+	// also at the top of the recorded stacks of more than
+	// HotThreshold goroutines, which may indicate contention. See
+	// also HotFunctions().
+	HotThreshold int
+
+	// CollapsePatterns lists regular expressions matching the
+	// names of wrapper functions, such as middleware, that tend to
+	// clutter the output. A run of two or more consecutive frames
+	// whose functions match the same pattern is printed as a single
+	// line with the number of frames collapsed.
+	CollapsePatterns []*regexp.Regexp
+
+	// CollapseRepeats causes a run of two or more consecutive frames
+	// with the same function and PC, as captured by deep recursion,
+	// to be printed as a single line with the number of repeats, such
+	// as "main.walk() (x4)". Unlike CollapsePatterns, it only merges
+	// identical call sites.
+	CollapseRepeats bool
+
+	// Predicate, if set, is called with the ID of the current
+	// goroutine at the start of every Trace(), and the call is
+	// ignored unless it returns true. It is evaluated before the
+	// stack is captured, so rejected calls are cheap; it may be
+	// used, for example, to trace only some goroutines or to
+	// sample calls. It must be safe for concurrent use.
+	Predicate func(goroutineID int) bool
+
+	// ShowGoroutineState causes the runtime state (eg "chan
+	// receive") of all recorded goroutines to be captured on every
+	// goroutine switch, and that of the goroutine being switched
+	// away from to be shown in the switch banner. This is useful
+	// for debugging hangs, but it is expensive since capturing the
+	// states stops the world.
+	ShowGoroutineState bool
+
+	// ShowIdleTime causes the switch banner to show how long ago the
+	// goroutine being switched to was last traced, such as "(idle
+	// 3.2s)", which helps to spot stalls.
+	ShowIdleTime bool
+
+	// EscapeControl causes control characters, such as newlines and
+	// tabs, in messages to be escaped (eg as "\n"), so that each
+	// frame stays on a single line of output and History remains
+	// parseable. It is set in Global, but like the other fields, it is
+	// false in a Tracer created otherwise, which must set it
+	// explicitly.
+	EscapeControl bool
+
+	// OnStart, if set, is called once when the Tracer is first
+	// active after having been off, before anything is recorded.
+	// It may be used for one-time setup, such as writing a header
+	// to Out. It is called again whenever the Tracer is turned off
+	// and back on. Since it may be called with the Tracer's mutex
+	// held, it must not call any of the Tracer's methods.
+	OnStart func(*Tracer)
+
+	// PrintBuildInfo causes a header describing the running binary,
+	// such as "build: main=example.com/app version=v1.2.0
+	// revision=0a1b2c3 go=go1.21.0", to be written to Out when the
+	// Tracer becomes active, just before OnStart is called, so that
+	// shared traces tell which binary produced them. Only the Go
+	// version is shown if the build information is unavailable.
+	PrintBuildInfo bool
+
+	// ShowFingerprint causes each frame to be printed along with
+	// the Fingerprint of its goroutine, which distinguishes
+	// goroutines whose IDs have been reused.
+	ShowFingerprint bool
+
+	// PrintCreationStack causes the site at which each goroutine was
+	// created to be printed the first time the goroutine is traced.
+	PrintCreationStack bool
+
+	// Tags holds metadata, such as the name and version of a
+	// service, that is appended as "key=value" pairs, sorted by
+	// key, to every frame line. This helps to disambiguate output
+	// from several programs merged into a single log.
+	Tags map[string]string
+
+	// ExpandInline causes frames whose calls were inlined by the
+	// compiler to be marked "(inlined)", so that they can be told
+	// apart from the physical frames into which they were folded.
+	ExpandInline bool
+
+	// ShareSwitchesByOut causes goroutine switches to be detected
+	// per Out rather than per Tracer: the switch banner is printed
+	// when the current goroutine differs from the last one that
+	// traced to the same Out through any Tracer with this option
+	// set. This keeps the banners coherent when several Tracers
+	// share an Out. The Logger must be comparable (eg a pointer).
+	ShareSwitchesByOut bool
+
+	// SwitchBannerThrottle, if positive, replaces the goroutine
+	// switch banner with a short "g17>" line, and skips reprinting
+	// the stack of the goroutine, when switching back to a goroutine
+	// that was active within the last SwitchBannerThrottle lines,
+	// counting those not written because of SilentCapture.
+	// This keeps the output of goroutines that alternate rapidly,
+	// such as a producer and a consumer, readable.
+	SwitchBannerThrottle int
+
+	// Logfmt causes frames to be printed as logfmt "key=value" pairs,
+	// such as
+	//
+	//	ts=2018-01-02T03:04:05Z g=17 level=3 func=main.f file=main.go:42 new=true msg="hello world"
+	//
+	// which are easier to process with tools than the default
+	// columns. Values containing spaces, quotes or "=" are quoted.
+	// Other lines, such as goroutine switch banners, are unaffected.
+	Logfmt bool
+
+	// HistorySummary causes the history of a goroutine, whether
+	// printed on a goroutine switch or by DumpAll(), to be followed
+	// by a summary of the number of frames recorded, the time
+	// between the first and last recorded frames, and the maximum
+	// depth of the stack.
+	HistorySummary bool
+
+	// MeasureOverhead causes the time spent in Trace() and its
+	// variants to be accumulated, as reported by Overhead(). It
+	// costs an additional call to ClockFn per trace.
+	MeasureOverhead bool
+
+	// Unsynchronized causes Trace(), its variants, TraceFrames() and
+	// Caller() not to acquire the Tracer's mutex, which saves its
+	// cost when tracing a single goroutine. It is NOT safe to trace
+	// from several goroutines concurrently with this option set;
+	// ensuring that it is not done is the caller's responsibility.
+	Unsynchronized bool
+
+	// ReplayCallout, if not zero, is prefixed to the lines of
+	// history reprinted on a goroutine switch (see
+	// OnGoroutineSwitchPrintStackHistory), such as '~', so that
+	// they can be told apart from live output.
+	ReplayCallout rune
+
+	// CoalesceWindow, if positive, causes the lines of calls to
+	// Trace() in quick succession from the same goroutine to be
+	// buffered and written to Out as a single block, once the
+	// window has elapsed since the first of them, as measured by
+	// ClockFn, or another goroutine traces. Since the window is only
+	// checked when tracing, call Flush() to write the last block.
+	CoalesceWindow time.Duration
+
+	// ShowAllocs causes the message of each Trace() call to be
+	// followed by the number of heap allocations since the previous
+	// call on the same goroutine, such as "+128 allocs". The count
+	// is process-wide, so it includes the allocations of other
+	// goroutines and of the Tracer itself. Since reading it stops the
+	// world (see runtime.ReadMemStats), this is costly and should
+	// only be enabled for targeted investigations.
+	ShowAllocs bool
+
+	// ContextFrames is the number of frames below the new ones,
+	// which were already printed by previous calls, to print again
+	// on every Trace() for context. They are printed without the
+	// "+" callout of new frames.
+	ContextFrames int
+
+	// ShowSource causes each frame to be followed by the trimmed
+	// text of its source line, such as "[42: x := compute()]", read
+	// from the file named in the frame. The snippet is omitted if
+	// the file cannot be read, for example because the program does
+	// not run where it was built. In Logfmt mode, the text is the
+	// value of the "src" key.
+	ShowSource bool
+
+	// ModulePrefix, if not empty, causes the functions starting with
+	// it, such as "github.com/me/myapp/", to be marked with a "*"
+	// before their name, so that the frames of your own code stand
+	// out from those of its dependencies.
+	ModulePrefix string
+
+	// StatsInterval, if positive, causes a summary of the output,
+	// such as "[trace] 12k lines, 340/s, 27 goroutines", to be
+	// written to Out every StatsInterval, as measured by ClockFn. The
+	// rate is that of the lines written since the previous summary.
+	// Since the interval is only checked when tracing, no summary is
+	// written while nothing is traced.
+	StatsInterval time.Duration
+
+	// SwitchOut, if not nil, receives the goroutine switch banners and
+	// the history reprinted after them (see
+	// OnGoroutineSwitchPrintStackHistory) instead of Out, for example
+	// to keep this metadata on stderr while the trace goes to a file.
+	// Lines written to SwitchOut are not counted in Stats.
+	SwitchOut Logger
+
+	// FrameEqual, if not nil, replaces FrameInfo.Same to decide
+	// whether a newly captured frame is the same as the one recorded
+	// at the same depth, in which case it is neither printed again nor
+	// recorded anew; for example, comparing only the functions treats
+	// frames at different lines of the same function as the same. It
+	// must be an equivalence relation (reflexive, symmetric and
+	// transitive) for the common frames to be well defined.
+	FrameEqual func(a, b *FrameInfo) bool
+
+	// SuppressIdenticalStacks causes a call to Trace() with the same
+	// stack as the previous call on the goroutine, such as a second
+	// call from the same line of a loop, to print nothing, including
+	// its message. By default, the top frame is always printed.
+	SuppressIdenticalStacks bool
+
+	// MaxDumpGoroutines, if positive, is the maximum number of
+	// goroutines whose history is written by DumpAll() and PrintTo().
+	// The most recently traced ones are written, followed by a
+	// "... and N more goroutines" footer.
+	MaxDumpGoroutines int
+
+	// MessagesOnly causes only the frames annotated with a message,
+	// normally the top frame of each Trace() call, to be printed,
+	// still indented according to their depth in the stack. This
+	// yields a sparse trace of the messages alone.
+	MessagesOnly bool
+
+	// SequenceNumbers causes each line written to Out or SwitchOut to
+	// be prefixed with a number incremented on every line, such as
+	// "#000123", which gives a total order of the output of all
+	// goroutines even if timestamps collide or the output is reordered
+	// downstream, for example with TraceAsync().
+	SequenceNumbers bool
+
+	// ShowDirection causes the message of each Trace() call to be
+	// prefixed with "↓" if the stack is deeper than on the previous
+	// call on the same goroutine, or "↑" if it is shallower, which
+	// makes calls and returns between traces obvious.
+	ShowDirection bool
+
+	// SlowThreshold, if positive, causes TraceEnter() to only print
+	// the entry into a function, along with its exit, if the call
+	// lasted longer than SlowThreshold, as measured by ClockFn. The
+	// stack is captured on entry and recorded on exit, so fast calls
+	// cost little and print nothing.
+	SlowThreshold time.Duration
+
+	// FrameDecorator, if not nil, is called with each rendered frame
+	// line, whether the frame is new, and its nesting level, and
+	// returns the line to print instead, for example wrapped in
+	// markup. It is called once the line is complete, including its
+	// callout, tags and, in Logfmt mode, its logfmt pairs.
+	FrameDecorator func(line string, isNew bool, level int) string
+
 	goroutines                  map[int]*GoroutineInfo
+	historySeq                  int
+	ring                        []historyEntry
+	ringNext                    int
+	silentBeforeRing            bool
 	mutex                       sync.Mutex
 	goroutineID                 int
+	switchForgotten             bool
 	indents                     []string
 	marker                      string
+	started                     int32
+	onState                     int32
+	captures                    int
+	collected                   []string
+	sessionStart                time.Time
+	sessionLines                int
+	sessionGoroutines           map[int]bool
+	lastLine                    string
+	repeats                     int
+	stats                       Stats
+	lastActive                  map[int]int
+	linesTraced                 int
+	pending                     []string
+	mallocs                     map[int]uint64
+	recent                      []string
+	recentNext                  int
+	sourceLines                 map[string][]string
+	pendingSince                time.Time
+	pendingGoroutine            int
+	pinnedID                    int
+	armFunction                 string
+	armRemaining                int
+	sections                    map[int]int
+	statsSince                  time.Time
+	statsSinceLines             int
+	sequence                    int
+	asyncMutex                  sync.Mutex
+	asyncQueue                  chan asyncCapture
 	calloutPrevious, calloutNew rune
 }
 
-// Goroutines returns a map of goroutine IDs to GoroutineInfo objects
-// reflecting the current state of `tr`. The returned map is a deep
-// copy of the internal state of `tr`.
-func (tr *Tracer) Goroutines() map[int]*GoroutineInfo {
-	if tr == nil {
-		return nil
+// historyEntry is a line of output recorded along with the goroutine
+// that emitted it.
+type historyEntry struct {
+	goroutineID int
+	key         string
+	line        string
+}
+
+// Configure calls `fn` with the mutex of `tr` held, so that `fn` can
+// safely change the public fields of `tr` while other goroutines are
+// tracing; the changes take effect on their next call to Trace(). Since
+// `fn` is called with the mutex held, it must not call any of the
+// Tracer's methods.
+//
+// Some fields are the exception, since they are read before the mutex
+// is acquired, to keep inactive and filtered out calls cheap, so they
+// must not be changed while other goroutines are tracing: On,
+// Capacity, ClockFn, Predicate and Unsynchronized, read by every
+// call, SlowThreshold and DurationPrecision, also read by
+// TraceEnter(), and FailFn, read by Assert(). Use SetOn() to turn
+// tracing on or off instead of changing On.
+func (tr *Tracer) Configure(fn func(tr *Tracer)) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	fn(tr)
+}
+
+// SetOut makes `out` the Logger receiving the output of `tr`, after
+// writing the lines still buffered because of CoalesceWindow or
+// DedupeConsecutive to the previous one. Unlike assigning Out directly, it rejects a nil `out`,
+// or one holding a nil pointer, which would only fail later in the
+// middle of Trace(); Out is left unchanged in that case. It may be
+// called while other goroutines are tracing. Set FallbackOnPanic to
+// also survive a Logger that fails once in use.
+func (tr *Tracer) SetOut(out Logger) error {
+	if tr == nil {
+		return errors.New("trace: SetOut called on a nil Tracer")
+	}
+	if out == nil {
+		return errors.New("trace: SetOut called with a nil Logger")
+	}
+	if value := reflect.ValueOf(out); value.Kind() == reflect.Ptr && value.IsNil() {
+		return fmt.Errorf("trace: SetOut called with a nil %T", out)
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if tr.Out != nil {
+		tr.flushRepeats()
+		tr.flushPending()
+	}
+	// Lines written to `out` are not duplicates of those written to
+	// the previous Logger.
+	tr.lastLine = ""
+	tr.Out = out
+	return nil
+}
+
+// LockToCurrent restricts tracing to the calling goroutine until
+// Unlock() is called: calls from any other goroutine are ignored.
+// Unlike LockGoroutine, which follows the last goroutine that traced,
+// this pins a specific goroutine, such as the one enabling tracing.
+func (tr *Tracer) LockToCurrent() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.pinnedID = GoroutineID()
+}
+
+// Unlock undoes LockToCurrent(), so that all goroutines are traced
+// again.
+func (tr *Tracer) Unlock() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.pinnedID = 0
+}
+
+// ResetGoroutineTracking forgets which goroutine traced last, so that
+// the next call to Trace() prints no goroutine switch banner, for
+// example after a known handoff between goroutines. Unlike SetOn(),
+// it keeps the recorded Frames and History of every goroutine. With
+// LockGoroutine set, the next goroutine to trace becomes the current
+// one.
+func (tr *Tracer) ResetGoroutineTracking() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.goroutineID = 0
+	tr.switchForgotten = true
+}
+
+// ArmAfter keeps `tr` silent until the function `fn`, such as
+// "main.(*server).handle", has been traced at the top of the stack
+// `count` times, for example to only trace an intermittent bug past
+// the 100th request. Output starts with the trace that reaches
+// `count`, which prints the whole stack since nothing is recorded
+// before. An empty `fn` or a non-positive `count` removes the trigger.
+func (tr *Tracer) ArmAfter(fn string, count int) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if count <= 0 {
+		fn = ""
+	}
+	tr.armFunction = fn
+	tr.armRemaining = count
+}
+
+// armed returns true unless ArmAfter() keeps `tr` silent, taking into
+// account a trace whose top frame is in `function`. It must be called
+// with tr.mutex held.
+func (tr *Tracer) armed(function string) bool {
+	if tr.armFunction == "" {
+		return true
+	}
+	if function == tr.armFunction {
+		tr.armRemaining--
+	}
+	if tr.armRemaining > 0 {
+		return false
+	}
+	tr.armFunction = ""
+	return true
+}
+
+// Goroutines returns a map of goroutine IDs to GoroutineInfo objects
+// reflecting the current state of `tr`. The returned map is a deep
+// copy of the internal state of `tr`.
+func (tr *Tracer) Goroutines() map[int]*GoroutineInfo {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	res := make(map[int]*GoroutineInfo, len(tr.goroutines))
+	for key, val := range tr.goroutines {
+		res[key] = val.Copy()
+	}
+	return res
+}
+
+// TopFunction returns the function at the top of the recorded stack
+// of the goroutine `goroutineID`, and false if that goroutine has no
+// recorded frames. Unlike Goroutines(), it copies nothing, so it is
+// cheap enough to be polled, for example to show what each goroutine
+// is doing in a live view.
+func (tr *Tracer) TopFunction(goroutineID int) (string, bool) {
+	if tr == nil {
+		return "", false
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	goroutine := tr.goroutines[goroutineID]
+	if goroutine == nil || len(goroutine.Frames) == 0 {
+		return "", false
+	}
+	return goroutine.Frames[0].Function, true
+}
+
+// IndentLevel returns the depth of the stack recorded by `tr` for the
+// goroutine `goroutineID`, or 0 if it has not been traced. Along with
+// Indentation(), it lets callers indent their own output like the
+// frames the goroutine would print next. It does not include the
+// levels added by Section().
+func (tr *Tracer) IndentLevel(goroutineID int) int {
+	if tr == nil {
+		return 0
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if goroutine := tr.goroutines[goroutineID]; goroutine != nil {
+		return len(goroutine.Frames)
+	}
+	return 0
+}
+
+// Indentation returns the indentation that `tr` prints before the
+// frames at nesting `level`, such as that returned by IndentLevel().
+func (tr *Tracer) Indentation(level int) string {
+	if tr == nil || level <= 0 {
+		return ""
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.indentation(level)
+}
+
+// RangeHistory calls `fn` with each line of the History of the
+// goroutine `goroutineID`, oldest first, until `fn` returns false.
+// Unlike Goroutines(), it does not copy anything, which makes it cheap
+// to search the History. Since `fn` is called with the mutex of `tr`
+// held, it must not call any of the Tracer's methods.
+func (tr *Tracer) RangeHistory(goroutineID int, fn func(line string) bool) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	goroutine := tr.goroutines[goroutineID]
+	if goroutine == nil {
+		return
+	}
+	for _, line := range goroutine.History {
+		if !fn(line) {
+			return
+		}
+	}
+}
+
+// ActiveGoroutines returns the IDs, in increasing order, of the
+// goroutines last traced by `tr` within the duration `within` before
+// now, as measured by ClockFn. Unlike Goroutines(),
+// which returns every goroutine ever traced, it tells which ones are
+// still active.
+func (tr *Tracer) ActiveGoroutines(within time.Duration) []int {
+	if tr == nil {
+		return nil
+	}
+	now := tr.clock()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	var ids []int
+	for id, goroutine := range tr.goroutines {
+		if !goroutine.LastRecorded.IsZero() && now.Sub(goroutine.LastRecorded) <= within {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// StatusTable returns a table of what each goroutine recorded by `tr`
+// is doing, as of its last trace: one row per goroutine, sorted by
+// ID, with the function and source location at the top of its stack
+// and how long ago it was recorded, such as
+//
+//	G   FUNCTION     LOCATION    AGE
+//	1   main.main()  main.go:12  3.0s
+//	17  main.f()     main.go:42  150ms
+//
+// This gives a view similar to top(1) for a live dashboard.
+func (tr *Tracer) StatusTable() string {
+	if tr == nil {
+		return ""
+	}
+	now := tr.clock()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	ids := make([]int, 0, len(tr.goroutines))
+	for id, goroutine := range tr.goroutines {
+		if len(goroutine.Frames) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	var table strings.Builder
+	writer := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "G\tFUNCTION\tLOCATION\tAGE")
+	for _, id := range ids {
+		top := tr.goroutines[id].Frames[0]
+		fmt.Fprintf(writer, "%d\t%s()\t%s:%d\t%s\n", id, top.Function, top.File, top.Line, tr.formatDuration(now.Sub(top.TimeRecorded)))
+	}
+	writer.Flush()
+	return strings.TrimRight(table.String(), "\n")
+}
+
+// SortedGoroutines returns deep copies of the GoroutineInfo objects
+// reflecting the current state of `tr`, sorted by goroutine ID. It is
+// useful for generating reproducible reports.
+func (tr *Tracer) SortedGoroutines() []*GoroutineInfo {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	res := make([]*GoroutineInfo, 0, len(tr.goroutines))
+	for _, val := range tr.goroutines {
+		res = append(res, val.Copy())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// HotFunctions returns the functions that are at the top of the
+// recorded stacks of more than `threshold` goroutines, mapped to the
+// number of such goroutines. Many goroutines stuck in the same
+// function (for example, waiting on a mutex) may indicate contention.
+func (tr *Tracer) HotFunctions(threshold int) map[string]int {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	res := make(map[string]int)
+	for function, count := range tr.topFunctionCounts() {
+		if count > threshold {
+			res[function] = count
+		}
+	}
+	return res
+}
+
+// topFunctionCounts returns the number of goroutines whose recorded
+// stack has each function at the top. It must be called with tr.mutex
+// held.
+func (tr *Tracer) topFunctionCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, goroutine := range tr.goroutines {
+		if len(goroutine.Frames) > 0 {
+			counts[goroutine.Frames[0].Function]++
+		}
+	}
+	return counts
+}
+
+// Stats holds counters describing the activity of a Tracer since it
+// was created or its ResetStats() method was last called, for example
+// to monitor the overhead of tracing. See Tracer.Stats().
+type Stats struct {
+	// Lines is the number of lines written to Out.
+	Lines int
+
+	// Traces is the number of calls to Trace() and its variants that
+	// recorded a stack, as opposed to returning early because the
+	// Tracer was off or the call was filtered out.
+	Traces int
+
+	// Dropped is the number of lines suppressed by DedupeConsecutive.
+	Dropped int
+
+	// Goroutines is the number of goroutines currently recorded.
+	Goroutines int
+
+	// Functions maps the function at the top of each traced stack to
+	// the number of times it was traced. At most 100 functions are
+	// counted individually; the rest are counted under "(other)".
+	Functions map[string]int
+
+	// Overhead is the time spent in Trace() and its variants, if
+	// the Tracer's MeasureOverhead option is on.
+	Overhead time.Duration
+}
+
+// Stats returns a snapshot of the counters of `tr`. Exporting them to
+// a monitoring system, such as Prometheus, is left to the caller so
+// that this package does not depend on it.
+func (tr *Tracer) Stats() Stats {
+	if tr == nil {
+		return Stats{}
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	res := tr.stats
+	res.Goroutines = len(tr.goroutines)
+	res.Functions = make(map[string]int, len(tr.stats.Functions))
+	for function, count := range tr.stats.Functions {
+		res.Functions[function] = count
+	}
+	return res
+}
+
+// Overhead returns the cumulative time spent in Trace() and its
+// variants, as measured with ClockFn, since `tr` was created or
+// ResetStats() was last called. It is only measured if the
+// MeasureOverhead option is on. Comparing it with the run time of the
+// program helps to decide whether tracing needs to be sampled.
+func (tr *Tracer) Overhead() time.Duration {
+	if tr == nil {
+		return 0
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.stats.Overhead
+}
+
+// ResetStats resets all the counters returned by Stats() and
+// Overhead() to zero.
+func (tr *Tracer) ResetStats() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.stats = Stats{}
+	tr.statsSinceLines = 0
+}
+
+// LinesEmitted returns the number of lines written to Out since `tr`
+// was created or ResetStats() was last called. A high count in
+// production is a sign that tracing was left on by mistake.
+func (tr *Tracer) LinesEmitted() int {
+	if tr == nil {
+		return 0
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.stats.Lines
+}
+
+// countFunction counts a trace of `function` in tr.stats. It must be
+// called with tr.mutex held.
+func (tr *Tracer) countFunction(function string) {
+	if tr.stats.Functions == nil {
+		tr.stats.Functions = make(map[string]int)
+	}
+	if _, ok := tr.stats.Functions[function]; !ok && len(tr.stats.Functions) >= maxStatsFunctions {
+		function = otherFunctions
+	}
+	tr.stats.Functions[function]++
+}
+
+// History returns a copy of all the lines ever emitted by `tr`, across
+// all goroutines, in the order in which they were emitted. Each line
+// is prefixed with the ID of the goroutine that emitted it. It is
+// merged from the History of each goroutine, so it takes no memory of
+// its own.
+func (tr *Tracer) History() []string {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.mergedHistory(func(string) bool { return true })
+}
+
+// HistoryByKey is like History, but only returns the lines emitted by
+// calls to TraceKey() with `key`.
+func (tr *Tracer) HistoryByKey(key string) []string {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.mergedHistory(func(lineKey string) bool { return lineKey == key })
+}
+
+// mergedHistory returns the lines of the History of every goroutine
+// traced with a key accepted by `keep`, in the order in which they
+// were recorded, as returned by History. It must be called with
+// tr.mutex held.
+func (tr *Tracer) mergedHistory(keep func(key string) bool) []string {
+	type sequencedLine struct {
+		seq  int
+		line string
+	}
+	var lines []sequencedLine
+	for _, goroutine := range tr.goroutines {
+		for idx, line := range goroutine.History {
+			if keep(goroutine.historyKeys[idx]) {
+				entry := historyEntry{goroutineID: goroutine.ID, line: line}
+				lines = append(lines, sequencedLine{goroutine.historySeqs[idx], entry.String()})
+			}
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].seq < lines[j].seq })
+	res := make([]string, len(lines))
+	for idx, line := range lines {
+		res[idx] = line.line
+	}
+	return res
+}
+
+// String returns `entry` as returned by History.
+func (entry historyEntry) String() string {
+	return fmt.Sprintf("g%d %s", entry.goroutineID, entry.line)
+}
+
+// The states of Tracer.onState: whether SetOn() has turned the Tracer
+// off or on, or has never been called, in which case Tracer.On is
+// used.
+const (
+	onStateUnset int32 = iota
+	onStateOff
+	onStateOn
+)
+
+// onStateFor returns the onState recording that SetOn(on) was called.
+func onStateFor(on bool) int32 {
+	if on {
+		return onStateOn
+	}
+	return onStateOff
+}
+
+// IsOn returns true if `tr` is on, as set by SetOn() or, if it was
+// never called, by the On field.
+func (tr *Tracer) IsOn() bool {
+	if tr == nil {
+		return false
+	}
+	switch atomic.LoadInt32(&tr.onState) {
+	case onStateOff:
+		return false
+	case onStateOn:
+		return true
+	}
+	return tr.On
+}
+
+// switchedOnOrOff returns true if SetOn() was ever called on `tr`.
+func (tr *Tracer) switchedOnOrOff() bool {
+	return atomic.LoadInt32(&tr.onState) != onStateUnset
+}
+
+// SetOn turns `tr` on or off, like setting tr.On before tracing, but
+// it is safe while other goroutines are tracing, and it also marks the
+// boundaries of each tracing session in the output: turning it on
+// emits a "tracing started" line, and turning it off emits a "tracing
+// stopped" line summarizing the session. Calls that do not change the
+// state of `tr` have no effect.
+func (tr *Tracer) SetOn(on bool) {
+	if tr == nil {
+		return
+	}
+	if !on {
+		defer tr.stopAsync()
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if on == tr.IsOn() {
+		atomic.StoreInt32(&tr.onState, onStateFor(on))
+		return
+	}
+
+	if on {
+		atomic.StoreInt32(&tr.onState, onStateOn)
+		if !tr.proceed() || tr.Out == nil {
+			return
+		}
+		tr.start()
+		tr.sessionStart = tr.clock()
+		tr.sessionGoroutines = make(map[int]bool)
+		tr.emit("=== tracing started ===")
+		tr.sessionLines = 0
+		return
+	}
+
+	if tr.proceed() && tr.Out != nil && !tr.sessionStart.IsZero() {
+		tr.emit(fmt.Sprintf("=== tracing stopped (%d lines, %d goroutines, %s) ===",
+			tr.sessionLines, len(tr.sessionGoroutines), tr.formatDuration(tr.clock().Sub(tr.sessionStart))))
+	}
+	tr.flushPending()
+	atomic.StoreInt32(&tr.onState, onStateOff)
+	atomic.StoreInt32(&tr.started, 0)
+	tr.sessionStart = time.Time{}
+	tr.sessionGoroutines = nil
+}
+
+// Enable turns `tr` on via SetOn() and returns a function that
+// restores it to its previous state. It is meant to be used as
+//
+//	defer tr.Enable()()
+//
+// to trace a region of code, and it nests correctly.
+func (tr *Tracer) Enable() (restore func()) {
+	if tr == nil {
+		return func() {}
+	}
+	previous := tr.IsOn()
+	tr.SetOn(true)
+	return func() { tr.SetOn(previous) }
+}
+
+// FlightRecorder configures `tr` as a flight recorder: it keeps only
+// the last `n` lines traced across all goroutines, in a ring buffer,
+// and emits no live output (see SilentCapture). The History is not
+// recorded in this mode, so memory use stays bounded. The recorded
+// lines can be written with DumpFlightRecorder(), for example when a
+// failure is detected. A non-positive `n` turns the flight recorder
+// off, and restores SilentCapture to its value before it was turned
+// on.
+func (tr *Tracer) FlightRecorder(n int) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.ringNext = 0
+	if n <= 0 {
+		if tr.ring != nil {
+			tr.SilentCapture = tr.silentBeforeRing
+		}
+		tr.ring = nil
+		return
+	}
+	if tr.ring == nil {
+		tr.silentBeforeRing = tr.SilentCapture
+	}
+	tr.ring = make([]historyEntry, n)
+	tr.SilentCapture = true
+}
+
+// RecentBuffer makes `tr` retain the last `n` lines written to Out,
+// across all goroutines, which Recent() returns. Unlike History, which
+// grows without bound, it is a small window meant, for example, to be
+// attached to error reports. A non-positive `n` stops retaining lines.
+func (tr *Tracer) RecentBuffer(n int) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.recentNext = 0
+	if n <= 0 {
+		tr.recent = nil
+		return
+	}
+	tr.recent = make([]string, n)
+}
+
+// Recent returns a copy of the lines retained because of
+// RecentBuffer(), oldest first.
+func (tr *Tracer) Recent() []string {
+	if tr == nil {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	first := 0
+	if tr.recentNext > len(tr.recent) {
+		first = tr.recentNext - len(tr.recent)
+	}
+	res := make([]string, 0, tr.recentNext-first)
+	for idx := first; idx < tr.recentNext; idx++ {
+		res = append(res, tr.recent[idx%len(tr.recent)])
+	}
+	return res
+}
+
+// GoldenDump writes the frames currently recorded for every goroutine
+// to `w` in a reproducible format, meant to be compared with a golden
+// file in tests of instrumented code: goroutines are numbered from 1
+// in the order in which they were first traced, and frames are
+// indented by their depth and shown without timestamps, program
+// counters or directories, such as
+//
+//	goroutine 1
+//	  main.main() main.go:12
+//	    main.work() main.go:42 hello
+func (tr *Tracer) GoldenDump(w io.Writer) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	goroutines := make([]*GoroutineInfo, 0, len(tr.goroutines))
+	for _, goroutine := range tr.goroutines {
+		goroutines = append(goroutines, goroutine)
+	}
+	sort.Slice(goroutines, func(i, j int) bool {
+		if first, second := goroutines[i].FirstRecorded, goroutines[j].FirstRecorded; !first.Equal(second) {
+			return first.Before(second)
+		}
+		return goroutines[i].ID < goroutines[j].ID
+	})
+	for idx, goroutine := range goroutines {
+		fmt.Fprintf(w, "goroutine %d\n", idx+1)
+		for level := 0; level < len(goroutine.Frames); level++ {
+			frameIdx := len(goroutine.Frames) - level - 1
+			frame := goroutine.Frames[frameIdx]
+			message := frame.Message
+			if !tr.FrameMessages && frameIdx == 0 {
+				message = goroutine.TopMessage
+			}
+			line := fmt.Sprintf("%s%s() %s:%d %s", tr.indentation(level+1), frame.Function, filepath.Base(frame.File), frame.Line, message)
+			fmt.Fprintln(w, strings.TrimRightFunc(line, unicode.IsSpace))
+		}
+	}
+}
+
+// DumpFlightRecorder writes the lines held by the flight recorder to
+// `w`, oldest first, in the format returned by History.
+func (tr *Tracer) DumpFlightRecorder(w io.Writer) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	first := 0
+	if tr.ringNext > len(tr.ring) {
+		first = tr.ringNext - len(tr.ring)
+	}
+	for idx := first; idx < tr.ringNext; idx++ {
+		fmt.Fprintln(w, tr.ring[idx%len(tr.ring)])
+	}
+}
+
+// DumpAll writes the History of every goroutine, in order of
+// goroutine ID, to Out. It writes even if SilentCapture is set.
+func (tr *Tracer) DumpAll() {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if tr.Out == nil {
+		return
+	}
+	tr.dump(tr.output)
+}
+
+// PrintTo is like DumpAll, but writes to `out` rather than Out. It
+// changes neither Out nor any other state of `tr`, such as the lines
+// counted in Stats, which makes it suitable for ad-hoc reports.
+func (tr *Tracer) PrintTo(out Logger) {
+	if tr == nil || out == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.dump(func(line string) { out.Printf("%s", line) })
+}
+
+// dump passes the History of every goroutine, in order of goroutine
+// ID, to `print`. It must be called with tr.mutex held.
+func (tr *Tracer) dump(print func(line string)) {
+	ids := make([]int, 0, len(tr.goroutines))
+	for id := range tr.goroutines {
+		ids = append(ids, id)
+	}
+	var omitted int
+	if tr.MaxDumpGoroutines > 0 && len(ids) > tr.MaxDumpGoroutines {
+		sort.Slice(ids, func(i, j int) bool {
+			return tr.goroutines[ids[i]].LastRecorded.After(tr.goroutines[ids[j]].LastRecorded)
+		})
+		omitted = len(ids) - tr.MaxDumpGoroutines
+		ids = ids[:tr.MaxDumpGoroutines]
+	}
+	sort.Ints(ids)
+	if omitted > 0 {
+		defer print(fmt.Sprintf("... and %d more goroutines", omitted))
+	}
+	marker := strings.Repeat("-", tr.markerWidth())
+	for _, id := range ids {
+		print(fmt.Sprintf("%s goroutine %d %s", marker, id, marker))
+		for _, line := range tr.goroutines[id].History {
+			print(line)
+		}
+		if tr.HistorySummary {
+			print(tr.historySummary(tr.goroutines[id]))
+		}
+	}
+}
+
+// TreeReport writes the recorded stacks of all goroutines to `w` as a
+// tree drawn with box-drawing characters. Stacks are merged from the
+// bottom up, so functions called from a common parent appear as
+// siblings under it.
+func (tr *Tracer) TreeReport(w io.Writer) {
+	if tr == nil {
+		return
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	ids := make([]int, 0, len(tr.goroutines))
+	for id := range tr.goroutines {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	root := &treeNode{}
+	for _, id := range ids {
+		node := root
+		frames := tr.goroutines[id].Frames
+		for idx := len(frames) - 1; idx >= 0; idx-- {
+			node = node.child(frames[idx].Function)
+		}
+	}
+	for _, node := range root.children {
+		fmt.Fprintf(w, "%s()\n", node.function)
+		node.write(w, "")
+	}
+}
+
+// treeNode is a function in the tree printed by TreeReport.
+type treeNode struct {
+	function string
+	children []*treeNode
+}
+
+// child returns the child of `node` for `function`, adding it if
+// necessary.
+func (node *treeNode) child(function string) *treeNode {
+	for _, child := range node.children {
+		if child.function == function {
+			return child
+		}
+	}
+	child := &treeNode{function: function}
+	node.children = append(node.children, child)
+	return child
+}
+
+// write writes the descendants of `node` to `w`, each line starting
+// with `prefix`.
+func (node *treeNode) write(w io.Writer, prefix string) {
+	for idx, child := range node.children {
+		glyph, indent := "├─ ", "│  "
+		if idx == len(node.children)-1 {
+			glyph, indent = "└─ ", "   "
+		}
+		fmt.Fprintf(w, "%s%s%s()\n", prefix, glyph, child.function)
+		child.write(w, prefix+indent)
+	}
+}
+
+// proceed returns false if `tr` is not active, as far as can be told
+// without holding tr.mutex. Out, which SetOut() and FallbackOnPanic
+// may replace while other goroutines are tracing, must be checked
+// with the mutex held, which acquire() does.
+func (tr *Tracer) proceed() bool {
+	if tr == nil {
+		return false
+	}
+	if !tr.IsOn() {
+		if atomic.LoadInt32(&tr.started) != 0 {
+			atomic.StoreInt32(&tr.started, 0)
+		}
+		return false
+	}
+	return tr.Capacity > 0
+}
+
+// start prepares `tr` to record a trace once proceed() has returned
+// true, calling OnStart if `tr` has just become active. Unlike
+// proceed(), which may be called without it, start must be called
+// with tr.mutex held.
+func (tr *Tracer) start() {
+	tr.prepare()
+	if atomic.CompareAndSwapInt32(&tr.started, 0, 1) {
+		if tr.PrintBuildInfo {
+			tr.emit(buildInfo())
+		}
+		if tr.OnStart != nil {
+			tr.OnStart(tr)
+		}
+	}
+}
+
+// prepare initializes the internal state of `tr` on first use. Unlike
+// start(), it has no visible effect, so it may be used by methods that
+// only format output, such as FormatFrame(). It must be called with
+// tr.mutex held.
+func (tr *Tracer) prepare() {
+	if tr.goroutines == nil {
+		tr.goroutines = make(map[int]*GoroutineInfo)
+		tr.calloutPrevious = ' '
+		tr.calloutNew = '+'
+	}
+}
+
+// buildInfo returns the header written if PrintBuildInfo is set.
+func buildInfo() string {
+	var pairs []string
+	add := func(key, value string) {
+		if value != "" {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	goVersion := runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		add("main", info.Main.Path)
+		add("version", info.Main.Version)
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				add("revision", setting.Value)
+			}
+		}
+		if info.GoVersion != "" {
+			goVersion = info.GoVersion
+		}
+	}
+	add("go", goVersion)
+	return "build: " + strings.Join(pairs, " ")
+}
+
+// clock returns the current time according to ClockFn, or time.Now
+// if ClockFn is not set.
+func (tr *Tracer) clock() time.Time {
+	if tr.ClockFn == nil {
+		return time.Now()
+	}
+	return tr.ClockFn()
+}
+
+// Trace records and echoes the state of the current goroutine's stack
+// since the last time it was recorded. Those "new" entries are
+// printed with a "+" marker. Previous entries on the call stack may
+// be printed depending on the values of
+// OnGoroutineSwitchPrintCurrentStack and
+// OnGoroutineSwitchPrintStackHistory; those previous entries will NOT
+// have a "+" marker.
+//
+// The time recorded for the new entries is read as soon as Trace is
+// called, before any of the tracer's own processing.
+//
+// Note that the output cannot distinguish between to consecutive
+// calls to Trace from the same stack frame, vs two consecutive calls
+// to Trace from sibling stack frames.
+//
+// The parameter `skip` denotes the number of
+// stack frames to skip in processing; a value of 0 denotes to start
+// processing with the caller of this function as the top of the stack.
+// Frames belonging to this package, such as those of trace.Trace(),
+// are always skipped automatically, so `skip` need only account for
+// the caller's own wrapper functions.
+func (tr *Tracer) Trace(skip int, args ...interface{}) {
+	tr.trace(skip, traceOptions{}, args...)
+}
+
+// TraceAsync is like Trace, but only captures the program counters of
+// the stack on the calling goroutine, which is the cheapest part of
+// tracing. They are symbolized, recorded and printed by a background
+// goroutine, started on first use, which exits when `tr` is turned
+// off with SetOn(false). Use Flush() to wait for the output of earlier
+// calls.
+// PrintCreationStack should not be combined with it, since it would
+// report the creation of the background goroutine.
+func (tr *Tracer) TraceAsync(skip int, args ...interface{}) {
+	call, ok := tr.admit(time.Time{})
+	if !ok {
+		return
+	}
+	pcs := make([]uintptr, tr.Capacity+skip+maxInternalFrames)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	tr.asyncMutex.Lock()
+	defer tr.asyncMutex.Unlock()
+	if tr.asyncQueue == nil {
+		tr.startAsync()
+	}
+	tr.asyncQueue <- asyncCapture{goroutineID: call.goroutineID, skip: skip, pcs: pcs, now: call.now, message: messageFrom(args...)}
+}
+
+// Flush waits until the stacks captured by earlier calls to
+// TraceAsync() have been recorded, and then writes any lines buffered
+// because of CoalesceWindow.
+func (tr *Tracer) Flush() {
+	if tr == nil {
+		return
+	}
+	tr.asyncMutex.Lock()
+	queue := tr.asyncQueue
+	flushed := make(chan struct{})
+	if queue != nil {
+		queue <- asyncCapture{flushed: flushed}
+	}
+	tr.asyncMutex.Unlock()
+	if queue != nil {
+		<-flushed
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.flushPending()
+}
+
+// asyncCapture is a stack captured by TraceAsync, or a marker sent by
+// Flush if `flushed` is not nil.
+type asyncCapture struct {
+	goroutineID int
+	skip        int
+	pcs         []uintptr
+	now         time.Time
+	message     string
+	flushed     chan struct{}
+}
+
+// asyncQueueSize is the number of captures that TraceAsync can queue
+// before blocking until the background goroutine catches up.
+const asyncQueueSize = 1024
+
+// startAsync starts the background goroutine serving TraceAsync. It
+// must be called with tr.asyncMutex held.
+func (tr *Tracer) startAsync() {
+	queue := make(chan asyncCapture, asyncQueueSize)
+	tr.asyncQueue = queue
+	go func() {
+		for capture := range queue {
+			if capture.flushed != nil {
+				close(capture.flushed)
+				continue
+			}
+			tr.recordAsync(capture)
+		}
+	}()
+}
+
+// stopAsync makes the background goroutine serving TraceAsync, if
+// any, exit once it has served the captures already queued. It must
+// be called without tr.mutex held: the goroutine needs it to make room
+// in the queue, which TraceAsync may be waiting for while holding
+// tr.asyncMutex.
+func (tr *Tracer) stopAsync() {
+	tr.asyncMutex.Lock()
+	defer tr.asyncMutex.Unlock()
+	if tr.asyncQueue != nil {
+		close(tr.asyncQueue)
+		tr.asyncQueue = nil
+	}
+}
+
+// recordAsync symbolizes, records and prints `capture`.
+func (tr *Tracer) recordAsync(capture asyncCapture) {
+	allFrameInfos := frameInfosFrom(runtime.CallersFrames(capture.pcs), capture.skip, tr.Capacity, capture.now)
+	if len(allFrameInfos) == 0 {
+		return
+	}
+
+	call := tracedCall{now: capture.now, goroutineID: capture.goroutineID, fixedTime: true}
+	if !tr.acquire(&call, false) {
+		return
+	}
+	defer tr.release(&call)
+	if !tr.armed(allFrameInfos[0].Function) {
+		return
+	}
+	tr.captures++
+	changedGoroutine, goroutine := tr.setGoroutine(capture.goroutineID, capture.now)
+	tr.record(goroutine, changedGoroutine, allFrameInfos, capture.now, traceOptions{}, "%s", capture.message)
+}
+
+// TraceLines is like Trace, but additionally returns the lines it
+// wrote to Out.
+func (tr *Tracer) TraceLines(skip int, args ...interface{}) []string {
+	return tr.trace(skip, traceOptions{collect: true}, args...)
+}
+
+// TraceEnter traces the entry into the calling function, annotated
+// with `args`, and returns a function to be called on exit, which
+// traces the exit along with the entry message, the time elapsed, and
+// optionally a result message made from its own arguments:
+//
+//	done := tr.TraceEnter("load %s", name)
+//	defer func() { done("-> %d rows", n) }()
+func (tr *Tracer) TraceEnter(args ...interface{}) (done func(result ...interface{})) {
+	if !tr.proceed() {
+		return func(...interface{}) {}
+	}
+	start := tr.clock()
+	entry := messageFrom(args...)
+	var pending *asyncCapture
+	if tr.SlowThreshold > 0 {
+		// Defer recording the entry until the exit tells whether
+		// the call was slow, unless the Predicate would drop both.
+		call, ok := tr.admit(start)
+		if !ok {
+			return func(...interface{}) {}
+		}
+		pcs := make([]uintptr, tr.Capacity+maxInternalFrames)
+		pcs = pcs[:runtime.Callers(1, pcs)]
+		pending = &asyncCapture{goroutineID: call.goroutineID, pcs: pcs, now: start, message: strings.TrimSpace("enter " + entry)}
+	} else {
+		tr.trace(0, traceOptions{}, "%s", strings.TrimSpace("enter "+entry))
+	}
+	return func(result ...interface{}) {
+		if !tr.proceed() {
+			return
+		}
+		if pending != nil {
+			if tr.clock().Sub(start) <= tr.SlowThreshold {
+				return
+			}
+			tr.recordAsync(*pending)
+		}
+		msg := strings.TrimSpace("exit " + entry)
+		if detail := messageFrom(result...); detail != "" {
+			msg += ": " + detail
+		}
+		msg += " (" + tr.formatDuration(tr.clock().Sub(start)) + ")"
+		tr.trace(0, traceOptions{}, "%s", msg)
+	}
+}
+
+// Section opens a logical section called `name` on the calling
+// goroutine, such as a phase of processing, and returns a function
+// that closes it:
+//
+//	defer tr.Section("parse")()
+//
+// It prints a "[name]" header, and the frames printed while the
+// section is open are indented one more level, regardless of the
+// frames on the stack. Sections may be nested; closing one also
+// closes the sections opened inside it and not closed yet.
+func (tr *Tracer) Section(name string) (done func()) {
+	if !tr.proceed() {
+		return func() {}
+	}
+	goroutineID := GoroutineID()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if tr.Out == nil {
+		return func() {}
+	}
+	tr.start()
+	if tr.lockedOut(goroutineID) {
+		return func() {}
+	}
+	if tr.sections == nil {
+		tr.sections = make(map[int]int)
+	}
+	depth := tr.sections[goroutineID]
+	tr.emit(tr.indentation(depth) + "[" + name + "]")
+	tr.sections[goroutineID] = depth + 1
+	return func() {
+		tr.mutex.Lock()
+		defer tr.mutex.Unlock()
+		if tr.sections[goroutineID] > depth {
+			tr.sections[goroutineID] = depth
+		}
+	}
+}
+
+// TraceAt is like Trace, but records the new frames as of time `t`
+// rather than the time returned by ClockFn. It is useful to replay
+// recorded events, or to control the time stamps of individual calls
+// in tests.
+func (tr *Tracer) TraceAt(t time.Time, skip int, args ...interface{}) {
+	tr.trace(skip, traceOptions{at: t}, args...)
+}
+
+// Caller prints a single line with the location and name of the
+// function that called the caller of Caller, annotated with `args`,
+// which are interpreted as parameters to fmt.Printf(). It is a
+// lightweight alternative to Trace for finding out "who called me":
+// nothing is recorded, so the line is never diffed against the
+// goroutine's stack nor reprinted on goroutine switches.
+func (tr *Tracer) Caller(args ...interface{}) {
+	call, ok := tr.admit(time.Time{})
+	if !ok || !tr.acquire(&call, false) {
+		return
+	}
+	defer tr.release(&call)
+	now, goroutineID := call.now, call.goroutineID
+	if tr.armFunction != "" {
+		return
+	}
+	frames := getFrameInfos(1, 1, now)
+	if len(frames) == 0 {
+		return
+	}
+	frame := frames[0]
+
+	var timestamp string
+	if !tr.OmitTime {
+		timestamp = tr.formatTime(now) + " "
+	}
+	location := tr.location(frame, goroutineID)
+	if location != "" {
+		location = fmt.Sprintf(location, tr.calloutNew)
+	}
+	message := messageFrom(args...)
+	if tr.EscapeControl {
+		message = escapeControl(message)
+	}
+	line := strings.TrimSpace(fmt.Sprintf("%s%s %s() %s", timestamp, location, frame.Function, message))
+	if tags := tr.renderTags(); tags != "" {
+		line += " " + tags
+	}
+	tr.emit(line)
+}
+
+// TraceDeep is like Trace, but captures up to `depth` frames of the
+// stack regardless of the configured Capacity. It is useful for a
+// single deep capture amid otherwise shallow tracing.
+func (tr *Tracer) TraceDeep(depth int, args ...interface{}) {
+	tr.trace(0, traceOptions{depth: depth}, args...)
+}
+
+// TraceToken is like Trace, but additionally tags the printed frames
+// with `tok`. Passing the same Token to several goroutines makes it
+// easy to correlate their output regardless of their goroutine IDs.
+func (tr *Tracer) TraceToken(tok Token, args ...interface{}) {
+	tr.trace(0, traceOptions{token: tok}, args...)
+}
+
+// TraceKey is like Trace, but additionally tags the recorded lines with
+// `key`, so that they can later be retrieved with HistoryByKey().
+func (tr *Tracer) TraceKey(key string, args ...interface{}) {
+	tr.trace(0, traceOptions{key: key}, args...)
+}
+
+// TraceAtLevel is like Trace, but prints the top frame indented at
+// nesting `level` (0 for the bottom of the stack) regardless of its
+// actual depth, which helps in generated or flattened code where the
+// depth of the stack is misleading. The frames printed below it are
+// not affected.
+func (tr *Tracer) TraceAtLevel(level int, args ...interface{}) {
+	if level < 0 {
+		level = 0
+	}
+	tr.trace(0, traceOptions{forceLevel: true, level: level}, args...)
+}
+
+// TraceErrChain traces the current stack, annotated with `args` and
+// `err`, and prints the errors wrapped by `err` beneath the top frame,
+// one per line, indented by their depth in the chain and truncated to
+// 200 characters. Errors are unwrapped with errors.Unwrap() or, for
+// errors wrapping several errors such as those made by errors.Join(),
+// their Unwrap() []error method. Nothing happens if `err` is nil or
+// the Tracer is not active.
+func (tr *Tracer) TraceErrChain(err error, args ...interface{}) {
+	if err == nil || !tr.proceed() {
+		return
+	}
+	message := err.Error()
+	if len(args) > 0 {
+		message = messageFrom(args...) + ": " + message
+	}
+	tr.trace(0, traceOptions{errorChain: errorChain(err, 0, nil)}, "%s", message)
+}
+
+// TraceErrStack traces the current stack, annotated with `args` and
+// `err`, and folds into it the stack carried by `err`, if any: its
+// frames are printed above the top of the current stack, from the
+// first one not shared with the current stack. An error carries a
+// stack if it has a StackTrace() method returning a slice of program
+// counters, like the errors of github.com/pkg/errors. Nothing happens
+// if `err` is nil or the Tracer is not active.
+func (tr *Tracer) TraceErrStack(err error, args ...interface{}) {
+	if err == nil || !tr.proceed() {
+		return
+	}
+	message := err.Error()
+	if len(args) > 0 {
+		message = messageFrom(args...) + ": " + message
+	}
+	tr.trace(0, traceOptions{errorStack: errorStack(err)}, "%s", message)
+}
+
+// Assert traces the current stack, annotated with `args`, if `cond`
+// is false, and then invokes FailFn if it is set. Nothing happens if
+// `cond` is true or the Tracer is not active. The parameter `skip`
+// has the same meaning as in Trace.
+func (tr *Tracer) Assert(skip int, cond bool, args ...interface{}) {
+	if cond || !tr.proceed() {
+		return
+	}
+	msg := "assertion failed"
+	if detail := messageFrom(args...); detail != "" {
+		msg += ": " + detail
+	}
+	tr.trace(skip, traceOptions{}, "%s", msg)
+	if tr.FailFn != nil {
+		tr.FailFn(msg)
+	}
+}
+
+// traceOptions holds the settings that distinguish the variants of
+// Trace.
+type traceOptions struct {
+	// token tags the printed frames (see TraceToken).
+	token Token
+
+	// key tags the recorded lines (see TraceKey).
+	key string
+
+	// collect causes trace to return the lines written to Out.
+	collect bool
+
+	// depth, if positive, overrides the Tracer's Capacity.
+	depth int
+
+	// errorStack holds the program counters of a stack to be folded
+	// on top of the captured one (see TraceErrStack).
+	errorStack []uintptr
+
+	// forceLevel causes the top frame to be printed at nesting
+	// `level` rather than its depth (see TraceAtLevel).
+	forceLevel bool
+	level      int
+
+	// errorChain holds the lines of the errors wrapped by a traced
+	// error (see TraceErrChain).
+	errorChain []string
+
+	// at, if not zero, is used instead of the ClockFn time.
+	at time.Time
+
+	// mallocs is the number of heap allocations so far, if
+	// ShowAllocs is set.
+	mallocs uint64
+}
+
+// tracedCall holds the state of a call to Trace() or one of its
+// variants between admit() and release().
+type tracedCall struct {
+	// now is the time of the call.
+	now time.Time
+
+	// goroutineID is the ID of the calling goroutine.
+	goroutineID int
+
+	// fixedTime is set if `now` was given by the caller rather than
+	// read from the clock, so that the call has no overhead to
+	// measure.
+	fixedTime bool
+
+	// mallocs is the number of heap allocations so far, if
+	// ShowAllocs is set and acquire() was asked for it.
+	mallocs uint64
+
+	// locked is set if acquire() acquired tr.mutex.
+	locked bool
+}
+
+// admit implements the checks shared by Trace() and its variants
+// before doing any work: it returns false if `tr` is not active or
+// the Predicate rejects the calling goroutine, as cheaply as possible
+// and without waiting on the mutex. Otherwise, it returns the call,
+// made at time `at` or, if it is zero, at the current time, which is
+// read before any of the tracer's own processing so that its
+// overhead is not attributed to the traced code.
+func (tr *Tracer) admit(at time.Time) (call tracedCall, ok bool) {
+	if !tr.proceed() {
+		return call, false
+	}
+	call.now, call.fixedTime = at, !at.IsZero()
+	if !call.fixedTime {
+		call.now = tr.clock()
+	}
+	call.goroutineID = GoroutineID()
+	if tr.Predicate != nil && !tr.Predicate(call.goroutineID) {
+		return call, false
+	}
+	return call, true
+}
+
+// acquire continues `call` once admit() has returned true: it acquires
+// the mutex unless Unsynchronized is set, starts `tr`, and returns
+// false if Out is nil, `tr` was turned off meanwhile, which matters for
+// the captures queued by TraceAsync(), or the calling goroutine is
+// locked out, in which case the mutex is released again. Otherwise, it reads the number of heap
+// allocations if `allocs` and ShowAllocs are set, writes the lines
+// due because of CoalesceWindow and StatsInterval, and the caller must
+// call release() when done.
+func (tr *Tracer) acquire(call *tracedCall, allocs bool) bool {
+	if !tr.Unsynchronized {
+		tr.mutex.Lock()
+		call.locked = true
+	}
+	if tr.Out == nil || !tr.proceed() {
+		if call.locked {
+			tr.mutex.Unlock()
+		}
+		return false
+	}
+	tr.start()
+	if tr.lockedOut(call.goroutineID) {
+		tr.release(call)
+		return false
+	}
+
+	// ReadMemStats stops the world, so leave it to calls that passed
+	// the Predicate.
+	if allocs && tr.ShowAllocs {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		call.mallocs = stats.Mallocs
+	}
+	tr.coalesce(call.now, call.goroutineID)
+	tr.summarizeStats(call.now)
+	return true
+}
+
+// release ends `call` after acquire() has returned true, accounting
+// for its overhead if MeasureOverhead is set and releasing the mutex.
+func (tr *Tracer) release(call *tracedCall) {
+	if tr.MeasureOverhead && !call.fixedTime {
+		tr.stats.Overhead += tr.clock().Sub(call.now)
+	}
+	if call.locked {
+		tr.mutex.Unlock()
+	}
+}
+
+// trace implements Trace and its variants. The parameter `skip` has
+// the same meaning as in Trace.
+func (tr *Tracer) trace(skip int, opts traceOptions, args ...interface{}) []string {
+	call, ok := tr.admit(opts.at)
+	if !ok || !tr.acquire(&call, true) {
+		return nil
+	}
+	defer tr.release(&call)
+	opts.mallocs = call.mallocs
+	now, goroutineID := call.now, call.goroutineID
+
+	if opts.collect {
+		tr.collected = []string{}
+		defer func() { tr.collected = nil }()
+	}
+
+	capacity := tr.Capacity
+	if opts.depth > 0 {
+		capacity = opts.depth
+	}
+	allFrameInfos := getFrameInfos(skip, capacity, now)
+	tr.captures++
+	if len(allFrameInfos) == 0 {
+		return nil
+	}
+	if len(opts.errorStack) > 0 {
+		allFrameInfos = foldErrorStack(opts.errorStack, allFrameInfos, now)
+	}
+	if !tr.armed(allFrameInfos[0].Function) {
+		return nil
+	}
+
+	changedGoroutine, goroutine := tr.setGoroutine(goroutineID, now)
+	tr.record(goroutine, changedGoroutine, allFrameInfos, now, opts, args...)
+	return tr.collected
+}
+
+// TraceFrames is like Trace, but rather than capturing the current
+// stack, it records and echoes `frames`, which are ordered with the
+// top of the stack first. This is useful to report a stack captured
+// earlier, for example via Goroutines(). The frames are copied, so
+// the caller may continue to use them. Frames with a zero
+// TimeRecorded are recorded at the current time.
+func (tr *Tracer) TraceFrames(frames []*FrameInfo, args ...interface{}) {
+	call, ok := tr.admit(time.Time{})
+	if !ok || !tr.acquire(&call, true) {
+		return
+	}
+	defer tr.release(&call)
+	now, goroutineID := call.now, call.goroutineID
+	if len(frames) == 0 || !tr.armed(frames[0].Function) {
+		return
+	}
+
+	changedGoroutine, goroutine := tr.setGoroutine(goroutineID, now)
+	allFrameInfos := make([]*FrameInfo, len(frames))
+	for idx, frame := range frames {
+		allFrameInfos[idx] = frame.Copy()
+		if allFrameInfos[idx].TimeRecorded.IsZero() {
+			allFrameInfos[idx].TimeRecorded = now
+		}
+	}
+	tr.record(goroutine, changedGoroutine, allFrameInfos, now, traceOptions{mallocs: call.mallocs}, args...)
+}
+
+// record merges `allFrameInfos`, the current stack of `goroutine`,
+// into its previously recorded frames and prints the result as of
+// time `now`. It must be called with tr.mutex held.
+func (tr *Tracer) record(goroutine *GoroutineInfo, changedGoroutine bool, allFrameInfos []*FrameInfo, now time.Time, opts traceOptions, args ...interface{}) {
+	tr.stats.Traces++
+	if len(allFrameInfos) > 0 {
+		tr.countFunction(allFrameInfos[0].Function)
+	}
+	goroutine.TopMessage = messageFrom(args...)
+	if tr.EscapeControl {
+		goroutine.TopMessage = escapeControl(goroutine.TopMessage)
+	}
+	if opts.mallocs != 0 {
+		if last, ok := tr.mallocs[goroutine.ID]; ok {
+			goroutine.TopMessage = strings.TrimSpace(fmt.Sprintf("%s +%d allocs", goroutine.TopMessage, opts.mallocs-last))
+		}
+		if tr.mallocs == nil {
+			tr.mallocs = make(map[int]uint64)
+		}
+		tr.mallocs[goroutine.ID] = opts.mallocs
+	}
+	if tr.ShowDirection && len(goroutine.Frames) > 0 {
+		if depth := len(allFrameInfos); depth > len(goroutine.Frames) {
+			goroutine.TopMessage = strings.TrimSpace("↓ " + goroutine.TopMessage)
+		} else if depth < len(goroutine.Frames) {
+			goroutine.TopMessage = strings.TrimSpace("↑ " + goroutine.TopMessage)
+		}
+	}
+	if tr.FrameMessages && len(allFrameInfos) > 0 {
+		allFrameInfos[0].Message = goroutine.TopMessage
+	}
+	goroutine.Token = opts.token
+	goroutine.Key = opts.key
+	if goroutine.Fingerprint == "" {
+		// The bottom frame may not be the entry function of the
+		// goroutine if Capacity truncated the stack, so later stacks
+		// cannot tell whether the ID was reused.
+		goroutine.Fingerprint = fingerprint(goroutine.ID, allFrameInfos)
+	}
+
+	equal := tr.FrameEqual
+	if equal == nil {
+		equal = (*FrameInfo).Same
+	}
+	lastCommonFrameStoredIdx, lastCommonFrameNewIdx := findLastCommonFrameIndexFunc(goroutine.Frames, allFrameInfos, equal, !tr.SuppressIdenticalStacks)
+
+	// Copying this way preserves the metadata in the common trace.Frames
+	goroutine.Frames = append(allFrameInfos[:lastCommonFrameNewIdx], goroutine.Frames[lastCommonFrameStoredIdx:]...)
+
+	if goroutine.FirstRecorded.IsZero() {
+		goroutine.FirstRecorded = now
+	}
+	goroutine.LastRecorded = now
+	goroutine.FramesRecorded += lastCommonFrameNewIdx
+	if len(goroutine.Frames) > goroutine.MaxDepth {
+		goroutine.MaxDepth = len(goroutine.Frames)
+	}
+
+	printFrom := lastCommonFrameNewIdx
+	if tr.ContextFrames > 0 {
+		printFrom += tr.ContextFrames
+		if printFrom > len(goroutine.Frames) {
+			printFrom = len(goroutine.Frames)
+		}
+	}
+	if changedGoroutine {
+		if tr.OnGoroutineSwitchPrintStackHistory {
+			tr.printHistory(goroutine)
+		} else if tr.OnGoroutineSwitchPrintCurrentStack {
+			printFrom = -1
+		}
+	}
+	topLevel := -1
+	if opts.forceLevel {
+		topLevel = opts.level
+	}
+	tr.printFrameIndicesLowerThan(goroutine, printFrom, lastCommonFrameNewIdx, topLevel, now)
+	if len(opts.errorChain) > 0 {
+		tr.printErrorChain(goroutine, opts.errorChain, now)
+	}
+
+	if tr.HotThreshold > 0 && len(goroutine.Frames) > 0 {
+		function := goroutine.Frames[0].Function
+		if count := tr.topFunctionCounts()[function]; count > tr.HotThreshold {
+			tr.emit(fmt.Sprintf("(hot: %s is at the top of %d goroutines)", function, count))
+		}
+	}
+}
+
+func (tr *Tracer) printHistory(goroutine *GoroutineInfo) {
+	for _, line := range goroutine.History {
+		if tr.ReplayCallout != 0 {
+			line = string(tr.ReplayCallout) + " " + line
+		}
+		tr.emitSwitch(line)
+	}
+	if tr.HistorySummary {
+		tr.emitSwitch(tr.historySummary(goroutine))
+	}
+}
+
+// historySummary returns the footer printed after the history of
+// `goroutine` if HistorySummary is set.
+func (tr *Tracer) historySummary(goroutine *GoroutineInfo) string {
+	return fmt.Sprintf("(goroutine %d: %d frames recorded in %s, max depth %d)", goroutine.ID,
+		goroutine.FramesRecorded, tr.formatDuration(goroutine.LastRecorded.Sub(goroutine.FirstRecorded)), goroutine.MaxDepth)
+}
+
+// prints all the frames in the goroutine with indices strictly lower
+// (ie frames higher on the stack) than idx, marking as new the ones
+// with indices strictly lower (ie frames higher on the stack) than
+// markFrom. The top frame is printed at nesting topLevel, unless it
+// is negative. Frame ages, if shown, are computed as of `now`.
+func (tr *Tracer) printFrameIndicesLowerThan(goroutine *GoroutineInfo, idx, markFrom, topLevel int, now time.Time) {
+	numFrames := len(goroutine.Frames)
+	if idx < 0 {
+		idx = numFrames
+	}
+	if markFrom < 0 {
+		markFrom = numFrames
+	}
+	idx--
+	if idx >= numFrames {
+		fmt.Printf("error: idx == %d, len(goroutine.Frames) == %d\n", idx, len(goroutine.Frames))
+	}
+	tags := tr.renderTags()
+	for ; idx >= 0; idx-- {
+		frame := goroutine.Frames[idx]
+		level := len(goroutine.Frames) - idx - 1
+		function := frame.Function + "()"
+		if run, pattern := tr.collapsibleRun(goroutine.Frames[:idx+1]); run > 1 {
+			function = fmt.Sprintf("[%d frames matching %s]", run, pattern)
+			idx -= run - 1
+		} else if run := tr.repeatedRun(goroutine.Frames[:idx+1]); run > 1 {
+			function += fmt.Sprintf(" (x%d)", run)
+			idx -= run - 1
+		} else if tr.ExpandInline && frame.Inlined {
+			function += " (inlined)"
+		}
+		var message string
+		if tr.FrameMessages {
+			message = frame.Message
+		} else if idx == 0 {
+			message = goroutine.TopMessage
+		}
+		if tr.MessagesOnly && message == "" {
+			continue
+		}
+		if idx == 0 && topLevel >= 0 {
+			level = topLevel
+		}
+		render := tr.frameRenderer(goroutine, frame, level, function, message, tags, now)
+		if decorate := tr.FrameDecorator; decorate != nil {
+			undecorated := render
+			render = func(isNew bool) string { return decorate(undecorated(isNew), isNew, level) }
+		}
+		tr.recordHistory(goroutine, render(false))
+		tr.emit(render(idx < markFrom))
+	}
+}
+
+// FormatFrame returns the line that `tr` prints for `frame` at
+// nesting `level` (0 for the bottom of the stack) of the goroutine
+// `goroutineID`, annotated with `message` and marked with the callout
+// of new frames if `isNew` is set. It is meant for tools that display
+// frames in the same layout as `tr`. It writes nothing, and works
+// whether or not `tr` is on. A negative `level` is treated as 0.
+func (tr *Tracer) FormatFrame(goroutineID, level int, frame *FrameInfo, isNew bool, message string) string {
+	if tr == nil || frame == nil {
+		return ""
+	}
+	if level < 0 {
+		level = 0
+	}
+	now := tr.clock()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.prepare()
+	goroutine := tr.goroutines[goroutineID]
+	if goroutine == nil {
+		goroutine = &GoroutineInfo{ID: goroutineID}
+	}
+	function := frame.Function + "()"
+	if tr.ExpandInline && frame.Inlined {
+		function += " (inlined)"
+	}
+	return tr.frameRenderer(goroutine, frame, level, function, message, tr.renderTags(), now)(isNew)
+}
+
+// frameRenderer returns a function rendering the line for `frame`,
+// printed with the label `function` at nesting `level` of
+// `goroutine`, marked as new or not. Frame ages, if shown, are
+// computed as of `now`. It must be called with tr.mutex held.
+func (tr *Tracer) frameRenderer(goroutine *GoroutineInfo, frame *FrameInfo, level int, function, message, tags string, now time.Time) func(isNew bool) string {
+	if tr.Logfmt {
+		return func(isNew bool) string {
+			return tr.logfmtLine(goroutine, frame, level, function, message, tags, isNew, now)
+		}
+	}
+	location := tr.location(frame, goroutine.ID)
+
+	var timestamp string
+	if !tr.OmitTime {
+		timestamp = tr.formatTime(frame.TimeRecorded) + " "
+	} else if tr.ReserveTimeColumn {
+		timestamp = strings.Repeat(" ", len(tr.formatTime(frame.TimeRecorded))+1)
+	}
+
+	var token string
+	if tr.ShowFingerprint {
+		token = "#" + goroutine.Fingerprint + " "
+	}
+	if goroutine.Token != "" {
+		token += goroutine.Token.String() + " "
+	}
+
+	var age string
+	if tr.ShowFrameAge {
+		age = fmt.Sprintf(" [age %s]", tr.formatDuration(now.Sub(frame.TimeRecorded)))
+	}
+	if text, ok := tr.sourceLine(frame); ok {
+		age += fmt.Sprintf(" [%d: %s]", frame.Line, text)
+	}
+
+	separator := " "
+	if tr.ModulePrefix != "" && strings.HasPrefix(frame.Function, tr.ModulePrefix) {
+		separator = "*"
+	}
+	// The callout is filled into the location column alone, so
+	// that the column may be omitted and messages may contain "%".
+	return func(isNew bool) string {
+		column := location
+		if column != "" {
+			callout := tr.calloutPrevious
+			if isNew {
+				callout = tr.calloutNew
+			}
+			column = fmt.Sprintf(column, callout)
+		}
+		line := strings.TrimRightFunc(fmt.Sprintf("%s%s%s%s%s%s%s %s", timestamp, column, token, tr.indentation(level+tr.sections[goroutine.ID]), separator, function, age, message), unicode.IsSpace)
+		if timestamp == "" && column == "" {
+			// Keep the indentation of the function column.
+			line = strings.TrimPrefix(line, " ")
+		} else if timestamp == "" {
+			line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		}
+		if tags != "" {
+			line += " " + tags
+		}
+		return line
+	}
+}
+
+// renderTags returns the Tags as space-separated "key=value" pairs in
+// key order.
+func (tr *Tracer) renderTags() string {
+	if len(tr.Tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tr.Tags))
+	for key := range tr.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for idx, key := range keys {
+		value := tr.Tags[key]
+		if tr.Logfmt {
+			value = logfmtValue(value)
+		}
+		pairs[idx] = key + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logfmtLine renders `frame`, printed with the label `function` at
+// nesting `level`, as logfmt pairs (see Tracer.Logfmt) followed by the
+// rendered `tags`.
+func (tr *Tracer) logfmtLine(goroutine *GoroutineInfo, frame *FrameInfo, level int, function, message, tags string, isNew bool, now time.Time) string {
+	var pairs []string
+	add := func(key, value string) {
+		pairs = append(pairs, key+"="+logfmtValue(value))
+	}
+	if !tr.OmitTime && tr.EpochTime {
+		add("ts", formatEpoch(frame.TimeRecorded))
+	} else if !tr.OmitTime {
+		add("ts", frame.TimeRecorded.Format(time.RFC3339Nano))
+	}
+	add("g", strconv.Itoa(goroutine.ID))
+	if tr.ShowFingerprint {
+		add("fingerprint", goroutine.Fingerprint)
+	}
+	if goroutine.Token != "" {
+		add("token", string(goroutine.Token))
+	}
+	add("level", strconv.Itoa(level))
+	add("func", strings.TrimSuffix(function, "()"))
+	add("file", fmt.Sprintf("%s:%d", frame.File, frame.Line))
+	if text, ok := tr.sourceLine(frame); ok {
+		add("src", text)
+	}
+	if tr.ShowFrameAge {
+		add("age", tr.formatDuration(now.Sub(frame.TimeRecorded)))
+	}
+	add("new", strconv.FormatBool(isNew))
+	if message != "" {
+		add("msg", message)
+	}
+	if tags != "" {
+		pairs = append(pairs, tags)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// sourceLine returns the trimmed text of the source line of `frame`
+// if ShowSource is set and it can be read. The lines of the files
+// read are cached in tr.sourceLines.
+func (tr *Tracer) sourceLine(frame *FrameInfo) (string, bool) {
+	if !tr.ShowSource || frame.File == "" {
+		return "", false
+	}
+	lines, ok := tr.sourceLines[frame.File]
+	if !ok {
+		if tr.sourceLines == nil || len(tr.sourceLines) >= maxCachedSourceFiles {
+			tr.sourceLines = make(map[string][]string)
+		}
+		if info, err := os.Stat(frame.File); err == nil && info.Size() <= maxSourceFileSize {
+			if content, err := ioutil.ReadFile(frame.File); err == nil {
+				lines = strings.Split(string(content), "\n")
+			}
+		}
+		// Unreadable files are cached too, so they are not retried.
+		tr.sourceLines[frame.File] = lines
+	}
+	if frame.Line < 1 || frame.Line > len(lines) {
+		return "", false
+	}
+	return strings.TrimSpace(lines[frame.Line-1]), true
+}
+
+// logfmtValue returns `value`, quoted if needed to be parsed back as a
+// single logfmt value.
+func logfmtValue(value string) string {
+	needsQuotes := strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '=' || r == '"'
+	}) >= 0
+	if value == "" || needsQuotes {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// recordHistory records `line` as emitted by `goroutine`, either in
+// the History, or only in the flight recorder if it is enabled.
+func (tr *Tracer) recordHistory(goroutine *GoroutineInfo, line string) {
+	entry := historyEntry{goroutineID: goroutine.ID, key: goroutine.Key, line: line}
+	if tr.ring != nil {
+		tr.ring[tr.ringNext%len(tr.ring)] = entry
+		tr.ringNext++
+		return
+	}
+	goroutine.History = append(goroutine.History, line)
+	goroutine.historySeqs = append(goroutine.historySeqs, tr.historySeq)
+	goroutine.historyKeys = append(goroutine.historyKeys, goroutine.Key)
+	tr.historySeq++
+}
+
+// collapsibleRun returns the length of the run of frames at the end
+// of `frames` (ie the lowest on the stack) whose functions all match
+// the same pattern in CollapsePatterns, along with that pattern.
+func (tr *Tracer) collapsibleRun(frames []*FrameInfo) (int, *regexp.Regexp) {
+	last := len(frames) - 1
+	for _, pattern := range tr.CollapsePatterns {
+		run := 0
+		for run <= last && pattern.MatchString(frames[last-run].Function) {
+			run++
+		}
+		if run > 0 {
+			return run, pattern
+		}
+	}
+	return 0, nil
+}
+
+// repeatedRun returns the length of the run of frames at the end of
+// `frames` (ie the lowest on the stack) with the same function and PC,
+// or 0 if CollapseRepeats is not set.
+func (tr *Tracer) repeatedRun(frames []*FrameInfo) int {
+	if !tr.CollapseRepeats {
+		return 0
+	}
+	last := len(frames) - 1
+	run := 1
+	for run <= last && frames[last-run].PC == frames[last].PC && frames[last-run].Function == frames[last].Function {
+		run++
+	}
+	return run
+}
+
+// emit writes `line` to Out as live output, which is suppressed if
+// SilentCapture is set.
+func (tr *Tracer) emit(line string) {
+	tr.linesTraced++
+	if tr.SilentCapture {
+		return
+	}
+	tr.output(line)
+}
+
+// emitSwitch emits `line`, which is part of the output on a goroutine
+// switch, to SwitchOut if it is set, or to Out otherwise.
+func (tr *Tracer) emitSwitch(line string) {
+	if tr.SwitchOut == nil {
+		tr.emit(line)
+	} else if !tr.SilentCapture {
+		tr.SwitchOut.Printf("%s", tr.sequenced(line))
+	}
+}
+
+// sequenced returns `line` prefixed with its sequence number if
+// SequenceNumbers is set. It must be called with tr.mutex held.
+func (tr *Tracer) sequenced(line string) string {
+	if !tr.SequenceNumbers {
+		return line
+	}
+	tr.sequence++
+	return fmt.Sprintf("#%06d %s", tr.sequence, line)
+}
+
+// output writes `line` to Out. If DedupeConsecutive is set, a line
+// identical to the previously emitted one is suppressed and counted
+// instead, and the count is reported before the next distinct line.
+func (tr *Tracer) output(line string) {
+	if tr.FallbackOnPanic {
+		defer tr.recoverOut(line)
 	}
-	res := make(map[int]*GoroutineInfo, len(tr.goroutines))
-	for key, val := range tr.goroutines {
-		res[key] = val.Copy()
+	if tr.DedupeConsecutive {
+		if line == tr.lastLine {
+			tr.repeats++
+			tr.stats.Dropped++
+			return
+		}
+		tr.flushRepeats()
+		tr.lastLine = line
 	}
-	return res
+	tr.write(line)
 }
 
-func (tr *Tracer) proceed() bool {
-	if tr == nil || !tr.On || tr.Out == nil || tr.Capacity <= 0 {
-		return false
+// flushRepeats reports the number of lines suppressed by
+// DedupeConsecutive since the last distinct line, if any.
+func (tr *Tracer) flushRepeats() {
+	if tr.repeats > 0 {
+		tr.write(fmt.Sprintf("(previous line repeated %d times)", tr.repeats))
+		tr.repeats = 0
 	}
-	if tr.goroutines == nil {
-		tr.goroutines = make(map[int]*GoroutineInfo)
-		tr.calloutPrevious = ' '
-		tr.calloutNew = '+'
+}
+
+// write writes `line` to Out, also collecting it if requested by the
+// current call to trace.
+func (tr *Tracer) write(line string) {
+	line = tr.sequenced(line)
+	if tr.CoalesceWindow > 0 {
+		tr.pending = append(tr.pending, line)
+	} else {
+		tr.Out.Printf("%s", line)
 	}
-	if tr.ClockFn == nil {
-		tr.ClockFn = time.Now
+	tr.sessionLines++
+	tr.stats.Lines++
+	if tr.collected != nil {
+		tr.collected = append(tr.collected, line)
+	}
+	if len(tr.recent) > 0 {
+		tr.recent[tr.recentNext%len(tr.recent)] = line
+		tr.recentNext++
 	}
-	return true
 }
 
-// Trace records and echoes the state of the current goroutine's stack
-// since the last time it was recorded. Those "new" entries are
-// printed with a "+" marker. Previous entries on the call stack may
-// be printed depending on the values of
-// OnGoroutineSwitchPrintCurrentStack and
-// OnGoroutineSwitchPrintStackHistory; those previous entries will NOT
-// have a "+" marker.
-//
-// Note that the output cannot distinguish between to consecutive
-// calls to Trace from the same stack frame, vs two consecutive calls
-// to Trace from sibling stack frames.
-//
-// The parameter `skip` denotes the number of
-// stack frames to skip in processing; a value of 0 denotes to start
-// processing with the caller of this function as the top of the stack.
-func (tr *Tracer) Trace(skip int, args ...interface{}) {
-	if !tr.proceed() {
+// summarizeStats writes the summary of StatsInterval if it has
+// elapsed as of `now` since the previous one, or since the first call.
+// It must be called with tr.mutex held.
+func (tr *Tracer) summarizeStats(now time.Time) {
+	if tr.StatsInterval <= 0 {
+		return
+	}
+	if tr.statsSince.IsZero() {
+		tr.statsSince, tr.statsSinceLines = now, tr.stats.Lines
+		return
+	}
+	elapsed := now.Sub(tr.statsSince)
+	if elapsed < tr.StatsInterval {
 		return
 	}
+	rate := float64(tr.stats.Lines-tr.statsSinceLines) / elapsed.Seconds()
+	tr.emit(fmt.Sprintf("[trace] %s lines, %.0f/s, %d goroutines", formatCount(tr.stats.Lines), rate, len(tr.goroutines)))
+	tr.statsSince, tr.statsSinceLines = now, tr.stats.Lines
+}
 
-	tr.mutex.Lock()
-	defer tr.mutex.Unlock()
+// formatCount returns `count` abbreviated with a "k" or "M" suffix if
+// it is large, such as "12k".
+func formatCount(count int) string {
+	switch {
+	case count >= 1000000:
+		return fmt.Sprintf("%dM", count/1000000)
+	case count >= 1000:
+		return fmt.Sprintf("%dk", count/1000)
+	}
+	return strconv.Itoa(count)
+}
+
+// coalesce writes the lines buffered because of CoalesceWindow if the
+// window has elapsed as of `now`, or if `goroutineID` is not the
+// goroutine that started it. If no lines are buffered afterwards, it
+// starts a new window. It must be called with tr.mutex held.
+func (tr *Tracer) coalesce(now time.Time, goroutineID int) {
+	if len(tr.pending) > 0 && (now.Sub(tr.pendingSince) > tr.CoalesceWindow || goroutineID != tr.pendingGoroutine) {
+		tr.flushPending()
+	}
+	if len(tr.pending) == 0 {
+		tr.pendingSince = now
+		tr.pendingGoroutine = goroutineID
+	}
+}
 
-	proceed, changedGoroutine, goroutine := tr.setGoroutine()
-	if !proceed {
+// flushPending writes the lines buffered because of CoalesceWindow to
+// Out as a single block. It must be called with tr.mutex held.
+func (tr *Tracer) flushPending() {
+	if len(tr.pending) == 0 {
 		return
 	}
+	block := strings.Join(tr.pending, "\n")
+	tr.pending = tr.pending[:0]
+	if tr.FallbackOnPanic {
+		defer tr.recoverOut(block)
+	}
+	tr.Out.Printf("%s", block)
+}
 
-	now := tr.ClockFn()
+// recoverOut recovers from a panic in Out while emitting `line`, in
+// which case it replaces Out with fallbackOut and emits `line` there.
+func (tr *Tracer) recoverOut(line string) {
+	if r := recover(); r != nil {
+		fallbackOut.Printf("error: Out panicked, falling back to stderr: %v", r)
+		tr.Out = fallbackOut
+		fallbackOut.Printf("%s", line)
+	}
+}
 
-	allFrameInfos := getFrameInfos(skip+1, tr.Capacity, now)
-	goroutine.TopMessage = messageFrom(args...)
+// location returns the source code column for `frame`, which is
+// SourceLength characters long and aligned according to SourceAlign,
+// unless the line number and the other fields do not fit. It contains
+// a "%c" verb for the callout, unless it is empty because
+// SourceLength is zero or negative.
+func (tr *Tracer) location(frame *FrameInfo, goroutineID int) string {
+	if tr.SourceLength <= 0 {
+		return ""
+	}
+	source := fmt.Sprintf("%s:%-4d", frame.File, frame.Line)
+	suffix := fmt.Sprintf("  p%d g%-*d%%c", frame.PC, tr.goroutineIDWidth(), goroutineID)
+	location := source + suffix
+	if utf8.RuneCountInString(location) > tr.SourceLength {
+		source = truncateSource(frame.File, frame.Line, tr.SourceLength-utf8.RuneCountInString(suffix))
+		location = source + suffix
+	}
+	var padding string
+	if length := utf8.RuneCountInString(location); length < tr.SourceLength {
+		padding = strings.Repeat(" ", tr.SourceLength-length)
+	}
+	if tr.SourceAlign == AlignLeft {
+		return source + padding + suffix
+	}
+	return padding + location
+}
 
-	lastCommonFrameStoredIdx, lastCommonFrameNewIdx := findLastCommonFrameIndex(goroutine.Frames, allFrameInfos)
+// truncateSource returns "file:line" for `file` and `line`, shortened
+// to fit in `width` runes if needed. The longest trailing part of the
+// path that fits, starting at a '/' or '\' separator, is kept after a
+// "…" marker, such as "…/pkg/foo.go:42"; if none fits, the end of the
+// file name is. The ":line" suffix is always kept, even if it alone
+// does not fit.
+func truncateSource(file string, line int, width int) string {
+	lineText := ":" + strconv.Itoa(line)
+	lineWidth := utf8.RuneCountInString(lineText)
+	runes := []rune(file)
+	if len(runes)+lineWidth <= width {
+		return file + lineText
+	}
+	base := 0
+	for idx, r := range runes {
+		if !isPathSeparator(r) {
+			continue
+		}
+		if 1+len(runes)-idx+lineWidth <= width {
+			return "…" + string(runes[idx:]) + lineText
+		}
+		base = idx + 1
+	}
+	keep := width - 1 - lineWidth
+	if keep <= 0 {
+		return "…" + lineText
+	}
+	if keep > len(runes)-base {
+		keep = len(runes) - base
+	}
+	return "…" + string(runes[len(runes)-keep:]) + lineText
+}
 
-	// Copying this way preserves the metadata in the common trace.Frames
-	goroutine.Frames = append(allFrameInfos[:lastCommonFrameNewIdx], goroutine.Frames[lastCommonFrameStoredIdx:]...)
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
 
-	printFrom := lastCommonFrameNewIdx
-	if changedGoroutine {
-		if tr.OnGoroutineSwitchPrintStackHistory {
-			tr.printHistory(goroutine)
-		} else if tr.OnGoroutineSwitchPrintCurrentStack {
-			printFrom = -1
-		}
+// writerRegistry records, for each Logger shared by Tracers with
+// ShareSwitchesByOut set, the goroutine that last traced to it.
+type writerRegistry struct {
+	mutex   sync.Mutex
+	writers map[Logger]int
+}
+
+// lastWriters is the registry shared by all Tracers.
+var lastWriters = &writerRegistry{writers: make(map[Logger]int)}
+
+// swap records `goroutineID` as the last goroutine to trace to `out`,
+// and returns the one previously recorded. If `out` cannot be used as
+// a map key, it returns `fallback` instead.
+func (reg *writerRegistry) swap(out Logger, goroutineID, fallback int) int {
+	if out == nil || !reflect.TypeOf(out).Comparable() {
+		return fallback
 	}
-	tr.printFrameIndicesLowerThan(goroutine, printFrom, lastCommonFrameNewIdx)
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	previous := reg.writers[out]
+	reg.writers[out] = goroutineID
+	return previous
 }
 
-func (tr *Tracer) printHistory(goroutine *GoroutineInfo) {
-	for _, line := range goroutine.History {
-		tr.Out.Println(line)
+// lockedOut returns true if LockGoroutine or LockToCurrent() prevent
+// tracing the goroutine `goroutineID`.
+func (tr *Tracer) lockedOut(goroutineID int) bool {
+	if tr.pinnedID != 0 && goroutineID != tr.pinnedID {
+		return true
 	}
+	return tr.LockGoroutine && !tr.switchForgotten && goroutineID != tr.goroutineID
 }
 
-// prints all the frames in the goroutine with indices strictly lower
-// (ie frames higher on the stack) than idx, marking as new the ones
-// with indices strictly lower (ie frames higher on the stack) than
-// markFrom.
-func (tr *Tracer) printFrameIndicesLowerThan(goroutine *GoroutineInfo, idx, markFrom int) {
-	numFrames := len(goroutine.Frames)
-	if idx < 0 {
-		idx = numFrames
+func (tr *Tracer) setGoroutine(goroutineID int, now time.Time) (changed bool, goroutine *GoroutineInfo) {
+	previousID := tr.goroutineID
+	if tr.ShareSwitchesByOut {
+		previousID = lastWriters.swap(tr.Out, goroutineID, previousID)
 	}
-	if markFrom < 0 {
-		markFrom = numFrames
+	if tr.switchForgotten {
+		previousID = goroutineID
+		tr.switchForgotten = false
 	}
-	idx--
-	if idx >= numFrames {
-		fmt.Printf("error: idx == %d, len(goroutine.Frames) == %d\n", idx, len(goroutine.Frames))
+	if goroutineID != previousID && tr.throttleSwitch(previousID, goroutineID) {
+		tr.emitSwitch(fmt.Sprintf("g%d>", goroutineID))
+	} else if goroutineID != previousID {
+		if width := tr.markerWidth(); len(tr.marker) != width {
+			tr.marker = strings.Repeat("-", width)
+		}
+		var state string
+		if tr.ShowGoroutineState {
+			tr.updateStates()
+			if previous := tr.goroutines[previousID]; previous != nil && previous.State != "" {
+				state = " [" + previous.State + "]"
+			}
+		}
+		var idle string
+		if incoming := tr.goroutines[goroutineID]; tr.ShowIdleTime && incoming != nil && !incoming.LastRecorded.IsZero() {
+			idle = " (idle " + tr.formatDuration(now.Sub(incoming.LastRecorded)) + ")"
+		}
+		width := tr.goroutineIDWidth()
+		tr.emitSwitch(fmt.Sprintf("%s goroutine switched: %*d%s -> %-*d%s %s", tr.marker, width, previousID, state, width, goroutineID, idle, tr.marker))
+		changed = true
 	}
-	for ; idx >= 0; idx-- {
-		var location string
-		frame := goroutine.Frames[idx]
-		if tr.SourceLength > 0 {
-			location = fmt.Sprintf("%200s:%-4d  p%d g%-3d%%c", frame.File, frame.Line, frame.PC, goroutine.ID)
-			if len(location) > tr.SourceLength {
-				location = location[len(location)-tr.SourceLength:]
+	tr.goroutineID = goroutineID
+	if tr.sessionGoroutines != nil {
+		tr.sessionGoroutines[goroutineID] = true
+	}
+	goroutine = tr.goroutines[tr.goroutineID]
+	if goroutine == nil {
+		goroutine = &GoroutineInfo{ID: goroutineID}
+		tr.goroutines[goroutineID] = goroutine
+		if tr.PrintCreationStack {
+			goroutine.CreatedBy = creationSite(stack(false))
+			if goroutine.CreatedBy != "" {
+				tr.emit(fmt.Sprintf("goroutine %d %s", goroutineID, goroutine.CreatedBy))
 			}
 		}
+	}
+	return changed, goroutine
+}
 
-		var timestamp string
-		if !tr.OmitTime {
-			timestamp = frame.TimeRecorded.Format("2006-01-02 15:04:05.00000000 ")
+// throttleSwitch records that `previousID` stopped being active, and
+// returns true if the banner for the switch to `goroutineID` should be
+// throttled according to SwitchBannerThrottle.
+func (tr *Tracer) throttleSwitch(previousID, goroutineID int) bool {
+	if tr.SwitchBannerThrottle <= 0 {
+		return false
+	}
+	if tr.lastActive == nil {
+		tr.lastActive = make(map[int]int)
+	}
+	tr.lastActive[previousID] = tr.linesTraced
+	last, ok := tr.lastActive[goroutineID]
+	return ok && tr.linesTraced-last <= tr.SwitchBannerThrottle
+}
+
+// updateStates sets the State of every recorded goroutine to its
+// current runtime state. Goroutines that have exited get the state
+// "exited".
+func (tr *Tracer) updateStates() {
+	states := goroutineStates()
+	for id, goroutine := range tr.goroutines {
+		state, ok := states[id]
+		if !ok {
+			state = "exited"
 		}
+		goroutine.State = state
+	}
+}
 
-		var message string
-		if idx == 0 {
-			message = goroutine.TopMessage
+// goroutineStates returns the runtime state (eg "chan receive" or
+// "select, 2 minutes") of every goroutine, keyed by goroutine ID. It
+// is parsed from the goroutine headers in the output of
+// runtime.Stack, which stops the world.
+func goroutineStates() map[int]string {
+	states := make(map[int]string)
+	for _, line := range strings.Split(string(stack(true)), "\n") {
+		// Headers look like "goroutine 18 [chan receive]:"
+		if !strings.HasPrefix(line, "goroutine ") || !strings.HasSuffix(line, "]:") {
+			continue
 		}
-		level := len(goroutine.Frames) - idx - 1
-		line := strings.TrimSpace(fmt.Sprintf("%s%s%s %s() %s", timestamp, location, tr.indentation(level), frame.Function, message))
-		goroutine.History = append(goroutine.History, fmt.Sprintf(line, tr.calloutPrevious))
-		callout := tr.calloutPrevious
-		if idx < markFrom {
-			callout = tr.calloutNew
+		fields := strings.SplitN(strings.TrimPrefix(line, "goroutine "), " [", 2)
+		if len(fields) != 2 {
+			continue
 		}
-		tr.Out.Printf(line, callout)
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		states[id] = strings.TrimSuffix(fields[1], "]:")
 	}
+	return states
 }
 
-func (tr *Tracer) setGoroutine() (proceed, changed bool, goroutine *GoroutineInfo) {
-	goroutineID := GoroutineID()
-	if goroutineID != tr.goroutineID {
-		if tr.LockGoroutine {
-			return false, true, nil
+// stack returns the output of runtime.Stack for the current
+// goroutine, or for all goroutines if `all` is set.
+func stack(all bool) []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// creationSite returns the "created by" entry, including its source
+// location, from the runtime.Stack output `buf` of a single goroutine,
+// or "" if there is none (as for the main goroutine).
+func creationSite(buf []byte) string {
+	lines := strings.Split(string(buf), "\n")
+	for idx, line := range lines {
+		if !strings.HasPrefix(line, "created by ") {
+			continue
 		}
-		if len(tr.marker) != tr.SourceLength {
-			tr.marker = strings.Repeat("-", tr.SourceLength)
+		site := line
+		if idx+1 < len(lines) {
+			// The location looks like "\t/path/file.go:12 +0x25"
+			location := strings.Fields(lines[idx+1])
+			if len(location) > 0 {
+				site += " at " + location[0]
+			}
 		}
-		tr.Out.Printf("%s goroutine switched: %3d -> %-3d %s", tr.marker, tr.goroutineID, goroutineID, tr.marker)
-		changed = true
+		return site
 	}
-	tr.goroutineID = goroutineID
-	goroutine = tr.goroutines[tr.goroutineID]
-	if goroutine == nil {
-		goroutine = &GoroutineInfo{ID: goroutineID}
-		tr.goroutines[goroutineID] = goroutine
+	return ""
+}
+
+// markerWidth returns the width of the markers surrounding the
+// goroutine switch banner: MarkerWidth if set, else SourceLength, but
+// never less than minMarkerWidth.
+func (tr *Tracer) markerWidth() int {
+	width := tr.MarkerWidth
+	if width <= 0 {
+		width = tr.SourceLength
+	}
+	if width < minMarkerWidth {
+		width = minMarkerWidth
+	}
+	return width
+}
+
+// goroutineIDWidth returns the width of goroutine IDs in the output.
+func (tr *Tracer) goroutineIDWidth() int {
+	if tr.GoroutineIDWidth <= 0 {
+		return defaultGoroutineIDWidth
 	}
-	return true, changed, goroutine
+	return tr.GoroutineIDWidth
 }
 
+// indentation returns the indentation for stack depth `level`. The
+// indentations of the first maxCachedIndents levels are cached;
+// deeper ones are computed on the fly so that a single very deep
+// stack does not permanently inflate the cache.
 func (tr *Tracer) indentation(level int) string {
+	if level >= maxCachedIndents {
+		return strings.Repeat("  ", level)
+	}
 	for level >= len(tr.indents) {
 		tr.indents = append(tr.indents, strings.Repeat("  ", len(tr.indents)))
 	}
 	return tr.indents[level]
 }
 
-// skip==0 is the caller of this function
+// getFrameInfos returns up to `capacity` frames of the current stack.
+// skip==0 is the innermost frame outside this package.
 func getFrameInfos(skip, capacity int, now time.Time) []*FrameInfo {
-	frames := runtimeFrames(skip+1, capacity)
+	return frameInfosFrom(runtimeFrames(0, capacity+skip+maxInternalFrames), skip, capacity, now)
+}
+
+// frameInfosFrom returns up to `capacity` of `frames`, skipping the
+// leading frames of this package and then `skip` more.
+func frameInfosFrom(frames *runtime.Frames, skip, capacity int, now time.Time) []*FrameInfo {
 	allFrameInfos := make([]*FrameInfo, 0, capacity)
-	for {
+	internal := true
+	for len(allFrameInfos) < capacity {
 		newFrameInfo, more := frames.Next()
-		allFrameInfos = append(allFrameInfos, from(newFrameInfo, now))
+		if newFrameInfo.PC == 0 {
+			// No frames were captured at all
+			break
+		} else if internal && isInternal(newFrameInfo) {
+			// Calibrate automatically past this package's own frames
+		} else if skip > 0 {
+			internal = false
+			skip--
+		} else {
+			internal = false
+			allFrameInfos = append(allFrameInfos, from(newFrameInfo, now))
+		}
 		if !more {
 			break
 		}
@@ -340,6 +3086,110 @@ func getFrameInfos(skip, capacity int, now time.Time) []*FrameInfo {
 	return allFrameInfos
 }
 
+// errorChain appends to `lines` the errors wrapped by `err`, each
+// indented by its `depth` in the chain, followed by the errors they
+// wrap in turn, and returns the result.
+func errorChain(err error, depth int, lines []string) []string {
+	var wrapped []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		wrapped = joined.Unwrap()
+	} else if inner := errors.Unwrap(err); inner != nil {
+		wrapped = []error{inner}
+	}
+	for _, inner := range wrapped {
+		if inner == nil {
+			continue
+		}
+		lines = append(lines, strings.Repeat("  ", depth)+TruncateError(inner, maxErrorChainLength))
+		lines = errorChain(inner, depth+1, lines)
+	}
+	return lines
+}
+
+// printErrorChain prints the lines of `chain` (see TraceErrChain)
+// aligned beneath the function of the top frame of `goroutine`.
+func (tr *Tracer) printErrorChain(goroutine *GoroutineInfo, chain []string, now time.Time) {
+	var pad string
+	if !tr.Logfmt && len(goroutine.Frames) > 0 {
+		function := goroutine.Frames[0].Function + "()"
+		top := tr.frameRenderer(goroutine, goroutine.Frames[0], len(goroutine.Frames)-1, function, "", "", now)(false)
+		if idx := strings.LastIndex(top, function); idx >= 0 {
+			pad = strings.Repeat(" ", utf8.RuneCountInString(top[:idx])+2)
+		}
+	}
+	for _, line := range chain {
+		if tr.EscapeControl {
+			line = escapeControl(line)
+		}
+		if tr.Logfmt {
+			text := strings.TrimLeft(line, " ")
+			line = fmt.Sprintf("g=%d depth=%d cause=%s", goroutine.ID, (len(line)-len(text))/2+1, logfmtValue(text))
+		} else {
+			line = pad + line
+		}
+		tr.recordHistory(goroutine, line)
+		tr.emit(line)
+	}
+}
+
+// errorStack returns the program counters of the stack carried by
+// `err`, if it has a StackTrace() method returning a slice of program
+// counters. Reflection is used so that, for example, the StackTrace
+// type of github.com/pkg/errors is recognized without depending on it.
+func errorStack(err error) []uintptr {
+	method := reflect.ValueOf(err).MethodByName("StackTrace")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return nil
+	}
+	stack := method.Call(nil)[0]
+	if stack.Kind() != reflect.Slice || stack.Type().Elem().Kind() != reflect.Uintptr {
+		return nil
+	}
+	pcs := make([]uintptr, stack.Len())
+	for idx := range pcs {
+		pcs[idx] = uintptr(stack.Index(idx).Uint())
+	}
+	return pcs
+}
+
+// foldErrorStack returns `current` with the frames of the stack
+// `pcs` on top of it, leaving out the bottom frames of `pcs` whose
+// functions are shared with `current`.
+func foldErrorStack(pcs []uintptr, current []*FrameInfo, now time.Time) []*FrameInfo {
+	var errorFrames []*FrameInfo
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.PC != 0 {
+			errorFrames = append(errorFrames, from(frame, now))
+		}
+		if !more {
+			break
+		}
+	}
+	errorIdx, currentIdx := len(errorFrames)-1, len(current)-1
+	for errorIdx >= 0 && currentIdx >= 0 && errorFrames[errorIdx].Function == current[currentIdx].Function {
+		errorIdx--
+		currentIdx--
+	}
+	return append(errorFrames[:errorIdx+1], current...)
+}
+
+// maxInternalFrames is an upper bound on the number of frames of this
+// package on the stack when it captures the stack.
+const maxInternalFrames = 10
+
+// packagePath is the import path of this package, as it appears in
+// the function names of stack frames.
+var packagePath = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(GoroutineID).Pointer()).Name(), ".GoroutineID")
+
+// isInternal returns true if `frame` belongs to this package. Frames
+// from test files are never considered internal, so that this
+// package's own tests are traced like any other code.
+func isInternal(frame runtime.Frame) bool {
+	return strings.HasPrefix(frame.Function, packagePath+".") && !strings.HasSuffix(frame.File, "_test.go")
+}
+
 // skip==0 is the caller of this function
 func runtimeFrames(skip, capacity int) *runtime.Frames {
 	pc := make([]uintptr, capacity)
@@ -357,6 +3207,16 @@ func runtimeFrames(skip, capacity int) *runtime.Frames {
 //   first[firstIdx+i].Same(second[secondIdx+i])) == true for all 0 <= i < len
 //   (firstIdx==secondIdx==0) == false
 func findLastCommonFrameIndex(first, second []*FrameInfo) (firstIdx, secondIdx int) {
+	return findLastCommonFrameIndexFunc(first, second, (*FrameInfo).Same, true)
+}
+
+// findLastCommonFrameIndexFunc is like findLastCommonFrameIndex, but
+// compares frames with `equal` (see Tracer.FrameEqual) rather than
+// FrameInfo.Same, so the second post-condition becomes
+// equal(first[firstIdx+i], second[secondIdx+i]) == true. Unless
+// `distinctTop` is set, it returns 0 for both indices if `first` and
+// `second` are entirely common (see Tracer.SuppressIdenticalStacks).
+func findLastCommonFrameIndexFunc(first, second []*FrameInfo, equal func(a, b *FrameInfo) bool, distinctTop bool) (firstIdx, secondIdx int) {
 	firstLen, secondLen := len(first), len(second)
 
 	// find firstIdx, secondIdx such that
@@ -371,7 +3231,7 @@ func findLastCommonFrameIndex(first, second []*FrameInfo) (firstIdx, secondIdx i
 	}
 
 	// avoid omitting consecutive calls from a loop
-	if firstIdx == 0 && secondIdx == 0 {
+	if firstIdx == 0 && secondIdx == 0 && distinctTop {
 		firstIdx++
 		secondIdx++
 	}
@@ -383,7 +3243,7 @@ func findLastCommonFrameIndex(first, second []*FrameInfo) (firstIdx, secondIdx i
 		// and second[secondIdx:] must match
 		matching := true
 		for increment = 0; firstIdx+increment < firstLen; increment++ {
-			if !first[firstIdx+increment].Same(second[secondIdx+increment]) {
+			if !equal(first[firstIdx+increment], second[secondIdx+increment]) {
 				matching = false
 				break
 			}
@@ -420,6 +3280,176 @@ func messageFrom(args ...interface{}) string {
 
 }
 
+// Token is a short identifier that can be shared among goroutines
+// (for example, a parent and the workers it fans out to) so that their
+// trace output can be correlated. Use NewToken to create one.
+type Token string
+
+// NewToken returns a new, randomly chosen Token.
+func NewToken() Token {
+	return Token(fmt.Sprintf("%04x", rand.Intn(0x10000)))
+}
+
+// String returns the representation of `tok` used in trace output.
+func (tok Token) String() string {
+	return "t=" + string(tok)
+}
+
+// FixedClock returns a function, suitable for Tracer.ClockFn, that
+// returns `start` on its first call and advances by `step` on every
+// subsequent call. It makes the output of time-dependent features,
+// such as durations and frame ages, deterministic in tests. The
+// returned function is safe for concurrent use.
+func FixedClock(start time.Time, step time.Duration) func() time.Time {
+	var mutex sync.Mutex
+	next := start
+	return func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := next
+		next = next.Add(step)
+		return now
+	}
+}
+
+// formatTime renders the time stamp `t` according to EpochTime and
+// TimePrecision.
+func (tr *Tracer) formatTime(t time.Time) string {
+	if tr.EpochTime {
+		return formatEpoch(t)
+	}
+	return t.Format(tr.TimePrecision.layout())
+}
+
+// formatEpoch renders `t` as seconds since the Unix epoch with a
+// nanosecond fraction.
+func formatEpoch(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// formatDuration renders `d` using the Tracer's DurationPrecision.
+func (tr *Tracer) formatDuration(d time.Duration) string {
+	precision := tr.DurationPrecision
+	if precision <= 0 {
+		precision = defaultDurationPrecision
+	}
+	return formatDuration(d, precision)
+}
+
+// formatDuration renders `d` in a compact, human-friendly form such as
+// "850ns", "1.2ms", "3.4s" or "2m01s", using the largest unit that
+// keeps the value above one and at most `precision` significant
+// digits. Durations of a minute or more are always shown to the
+// second.
+func formatDuration(d time.Duration, precision int) string {
+	if d < 0 {
+		return "-" + formatDuration(-d, precision)
+	}
+	switch {
+	case d < time.Microsecond:
+		return fmt.Sprintf("%dns", int64(d))
+	case d < time.Millisecond:
+		return formatDurationIn(d, time.Microsecond, "µs", precision)
+	case d < time.Second:
+		return formatDurationIn(d, time.Millisecond, "ms", precision)
+	case d < time.Minute:
+		return formatDurationIn(d, time.Second, "s", precision)
+	case d < time.Hour:
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%dm%02ds", int64(d/time.Minute), int64(d%time.Minute/time.Second))
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh%02dm", int64(d/time.Hour), int64(d%time.Hour/time.Minute))
+}
+
+// formatDurationIn renders `d` as a multiple of `unit`, with at most
+// `precision` significant digits but no fewer than the integer part.
+func formatDurationIn(d, unit time.Duration, suffix string, precision int) string {
+	value := float64(d) / float64(unit)
+	decimals := precision - len(strconv.Itoa(int(value)))
+	if decimals < 0 {
+		decimals = 0
+	}
+	return strconv.FormatFloat(value, 'f', decimals, 64) + suffix
+}
+
+// fingerprint returns a short hexadecimal hash of the goroutine ID
+// `id` and its stack `frames`.
+func fingerprint(id int, frames []*FrameInfo) string {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d", id)
+	for _, frame := range frames {
+		fmt.Fprintf(hash, "|%s", frame.Function)
+	}
+	return fmt.Sprintf("%06x", hash.Sum32()&0xffffff)
+}
+
+// Watcher traces changes to the value of a variable. Create one with
+// Tracer.Watch().
+type Watcher struct {
+	tracer *Tracer
+	name   string
+	value  reflect.Value
+	last   interface{}
+}
+
+// Watch returns a Watcher for the variable pointed to by `ptr`, which
+// is identified as `name` in the output. It panics if `ptr` is not a
+// non-nil pointer.
+func (tr *Tracer) Watch(name string, ptr interface{}) *Watcher {
+	value := reflect.ValueOf(ptr)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		panic(fmt.Sprintf("trace: Watch(%q) requires a non-nil pointer, got %T", name, ptr))
+	}
+	return &Watcher{
+		tracer: tr,
+		name:   name,
+		value:  value.Elem(),
+		last:   value.Elem().Interface(),
+	}
+}
+
+// Check traces the current stack if the watched variable has changed
+// since the Watcher was created or last checked, and returns true in
+// that case. Values are compared with reflect.DeepEqual against a
+// shallow copy, so changes to the elements of a watched slice or map
+// are not detected.
+func (w *Watcher) Check() bool {
+	current := w.value.Interface()
+	if reflect.DeepEqual(current, w.last) {
+		return false
+	}
+	w.tracer.trace(0, traceOptions{}, "%s changed: %v -> %v", w.name, w.last, current)
+	w.last = current
+	return true
+}
+
+// escapeControl returns `s` with control characters replaced by Go
+// escape sequences.
+func escapeControl(s string) string {
+	if strings.IndexFunc(s, unicode.IsControl) < 0 {
+		return s
+	}
+	var escaped strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			escaped.WriteString(`\n`)
+		case r == '\r':
+			escaped.WriteString(`\r`)
+		case r == '\t':
+			escaped.WriteString(`\t`)
+		case unicode.IsControl(r) && r < 0x100:
+			fmt.Fprintf(&escaped, `\x%02x`, r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&escaped, `\u%04x`, r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
 // TruncateError returns the string representation of `err` truncated
 // to `max` characters.
 func TruncateError(err error, max int) string {
@@ -430,39 +3460,137 @@ func TruncateError(err error, max int) string {
 	return msg
 }
 
+// goroutineIDBuffers holds the buffers used by GoroutineID(), which
+// would otherwise allocate one on each call.
+var goroutineIDBuffers = sync.Pool{New: func() interface{} { return new([64]byte) }}
+
 // GoroutineID returns the numerical ID of the currently running goroutine.
 func GoroutineID() int {
 	// Implementation taken from
 	// https://groups.google.com/forum/#!topic/golang-nuts/Nt0hVV_nqHE
-	var buf [64]byte
+	// but parsing the ID in place rather than splitting a string.
+	buf := goroutineIDBuffers.Get().(*[64]byte)
+	defer goroutineIDBuffers.Put(buf)
 	n := runtime.Stack(buf[:], false)
-	idField := strings.Fields(strings.TrimPrefix(string(buf[:n]), "goroutine "))[0]
-	id, err := strconv.Atoi(idField)
-	if err != nil {
-		panic(fmt.Sprintf("cannot get goroutine id: %v", err))
+	const prefix = "goroutine "
+	if n <= len(prefix) || string(buf[:len(prefix)]) != prefix {
+		panic("cannot get goroutine id from " + strconv.Quote(string(buf[:n])))
+	}
+	id, digits := 0, 0
+	for _, c := range buf[len(prefix):n] {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + int(c-'0')
+		digits++
+	}
+	if digits == 0 {
+		panic("cannot get goroutine id from " + strconv.Quote(string(buf[:n])))
 	}
 	return id
 }
 
+// fallbackOut is the Logger that replaces a panicking Tracer.Out when
+// FallbackOnPanic is set. It also receives the hint of HintWhenOff.
+var fallbackOut Logger = log.New(os.Stderr, "trace> ", 0)
+
 // Global is the global instance of Tracer, which can be easily
 // accessed by the trace.Trace() function. The public parameters of
 // Global may be changed dynamically and affect subsequent calls to
 // Trace(). Refer to this module's init() function for more
-// details.
+// details. Replacing Global itself while other goroutines may be
+// tracing is a data race: use SetGlobal() instead, after which the
+// package-level functions ignore Global.
 var Global *Tracer
 
+// globalTracer holds the *Tracer set by SetGlobal(), if any.
+var globalTracer atomic.Value
+
+// SetGlobal makes `tr` the Tracer used by the package-level functions,
+// such as Trace() and On(), in place of Global. Unlike assigning
+// Global, it is safe while other goroutines are tracing.
+func SetGlobal(tr *Tracer) {
+	globalTracer.Store(tr)
+}
+
+// GetGlobal returns the Tracer used by the package-level functions:
+// the one last passed to SetGlobal(), or Global if it was never
+// called.
+func GetGlobal() *Tracer {
+	if tr, ok := globalTracer.Load().(*Tracer); ok {
+		return tr
+	}
+	return Global
+}
+
+// HintWhenOff causes the first call to Trace() made before the global
+// debugger was ever turned on or off with On() to print a hint to
+// stderr saying that it is off, since a forgotten call to On(true) is
+// a common reason for missing output. Tracing that was turned off on
+// purpose does not trigger the hint.
+// It is initially set unless the TRACE_NOHINT environment variable is
+// set, and may be cleared before tracing to suppress the hint.
+var HintWhenOff = os.Getenv("TRACE_NOHINT") == ""
+
+// hintedOff is set once the hint of HintWhenOff has been printed.
+var hintedOff int32
+
 // Trace prints out the call stack of the current goroutine. The top
 // stack frame is annotated with `args`, which are interpreted as
 // parameters to fmt.Printf().
 func Trace(args ...interface{}) {
-	Global.Trace(1, args...)
+	tr := GetGlobal()
+	if tr != nil && !tr.IsOn() && !tr.switchedOnOrOff() && HintWhenOff && atomic.CompareAndSwapInt32(&hintedOff, 0, 1) {
+		fallbackOut.Printf("hint: trace.Trace() was called while tracing is off; call trace.On(true) to enable it, or set TRACE_NOHINT to hide this hint")
+	}
+	tr.Trace(0, args...)
+}
+
+// TraceEnter traces the entry into the calling function with the
+// global debugger, and returns a function that traces its exit. See
+// Tracer.TraceEnter().
+func TraceEnter(args ...interface{}) (done func(result ...interface{})) {
+	return GetGlobal().TraceEnter(args...)
+}
+
+// TraceErrStack traces `err` and the stack it carries, if any, with
+// the global debugger. See Tracer.TraceErrStack().
+func TraceErrStack(err error, args ...interface{}) {
+	GetGlobal().TraceErrStack(err, args...)
+}
+
+// TraceErrChain traces `err` and the errors it wraps with the global
+// debugger. See Tracer.TraceErrChain().
+func TraceErrChain(err error, args ...interface{}) {
+	GetGlobal().TraceErrChain(err, args...)
 }
 
-// On turns tracing with the global debugger on or off. It's nothing
-// more than a shorthand for setting Global.On manually.
+// Assert traces the call stack of the current goroutine if `cond` is
+// false. The top stack frame is annotated with `args`, which are
+// interpreted as parameters to fmt.Printf().
+func Assert(cond bool, args ...interface{}) {
+	GetGlobal().Assert(0, cond, args...)
+}
+
+// On turns tracing with the global debugger on or off. It's a
+// shorthand for GetGlobal().SetOn(), which also marks the start and
+// end of each tracing session in the output.
 func On(on bool) {
-	Global.On = on
+	GetGlobal().SetOn(on)
+}
+
+// Watch returns a Watcher that traces changes to the variable pointed
+// to by `ptr` with the global debugger. See Tracer.Watch().
+func Watch(name string, ptr interface{}) *Watcher {
+	return GetGlobal().Watch(name, ptr)
 }
+
+// Enable turns tracing with the global debugger on and returns a
+// function that restores its previous state. See Tracer.Enable().
+func Enable() (restore func()) {
+	return GetGlobal().Enable()
+}
+
 func init() {
 	Global = &Tracer{
 		// Any of these settings may be changed dynamically as
@@ -481,6 +3609,9 @@ func init() {
 		OnGoroutineSwitchPrintCurrentStack: false,
 		OnGoroutineSwitchPrintStackHistory: true,
 
+		// Keep each frame on a single line of output.
+		EscapeControl: true,
+
 		Capacity:     100,
 		Out:          log.New(os.Stdout, "trace> ", 0),
 		SourceLength: 40,
@@ -17,9 +17,20 @@ limitations under the License.
 package trace
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestFindLastCommonFrame(t *testing.T) {
@@ -112,3 +123,2891 @@ func fromStrings(labels ...string) []*FrameInfo {
 	}
 	return frames
 }
+
+func TestTraceToken(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tok := NewToken()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tr.TraceToken(tok, "worker %d", i)
+		}(i)
+	}
+	wg.Wait()
+
+	for id, goroutine := range tr.Goroutines() {
+		if got, want := goroutine.Token, tok; got != want {
+			t.Errorf("goroutine %d token: got %q, want %q", id, got, want)
+		}
+		if len(goroutine.History) == 0 {
+			t.Errorf("goroutine %d has no history", id)
+		}
+		for _, line := range goroutine.History {
+			if !strings.Contains(line, tok.String()) {
+				t.Errorf("goroutine %d: line %q does not contain token %q", id, line, tok)
+			}
+		}
+	}
+	if got, want := len(tr.Goroutines()), 3; got != want {
+		t.Errorf("number of goroutines: got %d, want %d", got, want)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	var failures []string
+	tr.FailFn = func(msg string) {
+		failures = append(failures, msg)
+	}
+
+	tr.Assert(0, true, "never printed")
+	if len(out.lines) != 0 || len(failures) != 0 {
+		t.Fatalf("Assert(true): got output %q and failures %q, want none", out.lines, failures)
+	}
+
+	tr.Assert(0, false, "x=%d", 3)
+	if len(out.lines) == 0 {
+		t.Fatalf("Assert(false): got no output")
+	}
+	if got, want := out.lines[len(out.lines)-1], "assertion failed: x=3"; !strings.HasSuffix(got, want) {
+		t.Errorf("Assert(false) last line: got %q, want suffix %q", got, want)
+	}
+	if got, want := failures, []string{"assertion failed: x=3"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Assert(false) failures: got %q, want %q", got, want)
+	}
+}
+
+func TestSourceAlign(t *testing.T) {
+	frame := &FrameInfo{Frame: runtime.Frame{File: "a.go", Line: 3, PC: 7}}
+	for _, tc := range []struct {
+		align Alignment
+		want  string
+	}{
+		{AlignRight, "          a.go:3     p7 g12 %c"},
+		{AlignLeft, "a.go:3               p7 g12 %c"},
+	} {
+		tr := &Tracer{SourceLength: 30, SourceAlign: tc.align}
+		if got := tr.location(frame, 12); got != tc.want {
+			t.Errorf("alignment %d: got %q, want %q", tc.align, got, tc.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.Trace(0, "main")
+	done := make(chan struct{})
+	go func() {
+		tr.Trace(0, "other")
+		close(done)
+	}()
+	<-done
+	tr.Trace(0, "main again")
+
+	history := tr.History()
+	var want []string
+	for _, goroutine := range tr.Goroutines() {
+		for _, line := range goroutine.History {
+			want = append(want, fmt.Sprintf("g%d %s", goroutine.ID, line))
+		}
+	}
+	if got, want := len(history), len(want); got != want {
+		t.Fatalf("history length: got %d, want %d", got, want)
+	}
+	for _, line := range want {
+		found := false
+		for _, got := range history {
+			if got == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("history is missing line %q", line)
+		}
+	}
+	for idx, message := range []string{"main", "other", "main again"} {
+		var found bool
+		for _, line := range history {
+			if strings.HasSuffix(line, "() "+message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("message %d (%q) missing from history", idx, message)
+		}
+	}
+	if last := history[len(history)-1]; !strings.HasSuffix(last, "main again") {
+		t.Errorf("last history line: got %q, want suffix %q", last, "main again")
+	}
+}
+
+func TestDedupeConsecutive(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.DedupeConsecutive = true
+
+	for i := 0; i < 5; i++ {
+		tr.Trace(0, "polling")
+	}
+	before := len(out.lines)
+	tr.Trace(0, "done")
+
+	if got, want := out.lines[before], "(previous line repeated 4 times)"; got != want {
+		t.Errorf("dedupe summary: got %q, want %q", got, want)
+	}
+	if got, want := out.lines[before+1], "done"; !strings.HasSuffix(got, want) {
+		t.Errorf("line after summary: got %q, want suffix %q", got, want)
+	}
+	for idx := 1; idx < before; idx++ {
+		if out.lines[idx] == out.lines[idx-1] {
+			t.Errorf("line %d repeats the previous line: %q", idx, out.lines[idx])
+		}
+	}
+}
+
+func TestDedupeConsecutiveAcrossSetOut(t *testing.T) {
+	first, second := &recordingLogger{}, &recordingLogger{}
+	tr := newTestTracer(first)
+	tr.OmitTime = true
+	tr.DedupeConsecutive = true
+	frames := functionFrames("main.poll", "main.main")
+	tr.TraceFrames(frames, "polling")
+	tr.TraceFrames(frames, "polling")
+	if err := tr.SetOut(second); err != nil {
+		t.Fatal(err)
+	}
+	tr.TraceFrames(frames, "polling")
+
+	if got, want := first.lines[len(first.lines)-1], "(previous line repeated 1 times)"; got != want {
+		t.Errorf("got last line %q to the previous Logger, want %q", got, want)
+	}
+	if len(second.lines) != 1 || !strings.HasSuffix(second.lines[0], "main.poll() polling") {
+		t.Errorf("got lines %q to the new Logger, want the traced line", second.lines)
+	}
+}
+
+func TestGoroutineSwitchMarker(t *testing.T) {
+	for _, tc := range []struct {
+		sourceLength, markerWidth int
+		wantWidth                 int
+	}{
+		{sourceLength: 0, wantWidth: minMarkerWidth},
+		{sourceLength: 40, wantWidth: 40},
+		{sourceLength: 0, markerWidth: 20, wantWidth: 20},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.SourceLength = tc.sourceLength
+		tr.MarkerWidth = tc.markerWidth
+		tr.Trace(0)
+
+		marker := strings.Repeat("-", tc.wantWidth)
+		banner := out.lines[0]
+		if !strings.HasPrefix(banner, marker+" goroutine switched") || !strings.HasSuffix(banner, " "+marker) {
+			t.Errorf("SourceLength %d, MarkerWidth %d: got banner %q, want %d-wide markers",
+				tc.sourceLength, tc.markerWidth, banner, tc.wantWidth)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d         time.Duration
+		precision int
+		want      string
+	}{
+		{850 * time.Nanosecond, 2, "850ns"},
+		{1500 * time.Nanosecond, 2, "1.5µs"},
+		{1234567 * time.Nanosecond, 2, "1.2ms"},
+		{1234567 * time.Nanosecond, 3, "1.23ms"},
+		{123456789 * time.Nanosecond, 2, "123ms"},
+		{3400 * time.Millisecond, 2, "3.4s"},
+		{2*time.Minute + 1*time.Second, 2, "2m01s"},
+		{3*time.Hour + 5*time.Minute, 2, "3h05m"},
+		{-1500 * time.Millisecond, 2, "-1.5s"},
+	} {
+		if got := formatDuration(tc.d, tc.precision); got != tc.want {
+			t.Errorf("formatDuration(%v, %d): got %q, want %q", tc.d, tc.precision, got, tc.want)
+		}
+	}
+}
+
+func TestFallbackOnPanic(t *testing.T) {
+	fallback := &recordingLogger{}
+	defer func(saved Logger) { fallbackOut = saved }(fallbackOut)
+	fallbackOut = fallback
+
+	tr := newTestTracer(panickingLogger{})
+	tr.FallbackOnPanic = true
+	tr.Trace(0, "survived")
+
+	if tr.Out != fallbackOut {
+		t.Errorf("Out was not replaced by the fallback Logger")
+	}
+	if len(fallback.lines) == 0 || !strings.Contains(fallback.lines[0], "closed") {
+		t.Fatalf("fallback output does not report the panic: %q", fallback.lines)
+	}
+	if last := fallback.lines[len(fallback.lines)-1]; !strings.HasSuffix(last, "survived") {
+		t.Errorf("last fallback line: got %q, want suffix %q", last, "survived")
+	}
+	var reports int
+	for _, line := range fallback.lines {
+		if strings.Contains(line, "panicked") {
+			reports++
+		}
+	}
+	if reports != 1 {
+		t.Errorf("panic reported %d times, want once", reports)
+	}
+}
+
+func TestFallbackOnPanicWhileTracing(t *testing.T) {
+	defer func(saved Logger) { fallbackOut = saved }(fallbackOut)
+	fallbackOut = &recordingLogger{}
+
+	tr := newTestTracer(panickingLogger{})
+	tr.FallbackOnPanic = true
+	// Run with -race to check that replacing Out while other
+	// goroutines trace is not a data race.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				tr.Trace(0, "working")
+			}
+		}()
+	}
+	wg.Wait()
+	if tr.Out != fallbackOut {
+		t.Errorf("Out was not replaced by the fallback Logger")
+	}
+}
+
+// panickingLogger is a Logger that always panics.
+type panickingLogger struct{}
+
+func (panickingLogger) Printf(format string, v ...interface{}) { panic("writer closed") }
+func (panickingLogger) Println(v ...interface{})               { panic("writer closed") }
+
+func TestTraceFrames(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.OnGoroutineSwitchPrintStackHistory = false
+
+	tr.TraceFrames(functionFrames("main.b", "main.a", "main.main"), "first")
+	tr.TraceFrames(functionFrames("main.c", "main.a", "main.main"), "second")
+
+	want := []string{
+		"+ main.main()",
+		"+   main.a()",
+		"+     main.b() first",
+		"+     main.c() second",
+	}
+	if got := out.lines[1:]; len(got) != len(want) {
+		t.Fatalf("got lines %q, want suffixes %q", got, want)
+	}
+	for idx, line := range out.lines[1:] {
+		if !strings.HasSuffix(line, want[idx]) {
+			t.Errorf("line %d: got %q, want suffix %q", idx, line, want[idx])
+		}
+	}
+}
+
+func TestShowFrameAge(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.ShowFrameAge = true
+	tr.OnGoroutineSwitchPrintStackHistory = false
+	tr.OnGoroutineSwitchPrintCurrentStack = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), time.Second)
+
+	// Switching to another goroutine and back reprints the whole
+	// stack of the main goroutine, with the age of each frame.
+	elsewhere := func() {
+		done := make(chan struct{})
+		go func() {
+			tr.TraceFrames(functionFrames("main.other"))
+			close(done)
+		}()
+		<-done
+	}
+	tr.TraceFrames(functionFrames("main.a", "main.main"))
+	elsewhere()
+	tr.TraceFrames(functionFrames("main.b", "main.a", "main.main"))
+	elsewhere()
+	out.lines = nil
+	tr.TraceFrames(functionFrames("main.c", "main.b", "main.a", "main.main"))
+
+	want := []string{
+		" main.main() [age 4.0s]",
+		"   main.a() [age 4.0s]",
+		"     main.b() [age 2.0s]",
+		"+       main.c() [age 0ns]",
+	}
+	if got := out.lines[1:]; len(got) != len(want) {
+		t.Fatalf("got lines %q, want suffixes %q", got, want)
+	}
+	for idx, line := range out.lines[1:] {
+		if !strings.HasSuffix(line, want[idx]) {
+			t.Errorf("line %d: got %q, want suffix %q", idx, line, want[idx])
+		}
+	}
+}
+
+func TestSilentCapture(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.SilentCapture = true
+	tr.Trace(0, "first")
+	tr.Trace(0, "second")
+
+	if len(out.lines) != 0 {
+		t.Fatalf("got live output %q, want none", out.lines)
+	}
+	goroutines := tr.Goroutines()
+	if len(goroutines) != 1 {
+		t.Fatalf("got %d goroutines, want 1", len(goroutines))
+	}
+	var history []string
+	for _, goroutine := range goroutines {
+		history = goroutine.History
+	}
+	if len(history) == 0 {
+		t.Fatalf("no history was recorded")
+	}
+
+	tr.DumpAll()
+	if got, want := len(out.lines), len(history)+1; got != want {
+		t.Fatalf("DumpAll wrote %d lines, want %d", got, want)
+	}
+	for idx, line := range history {
+		if got := out.lines[idx+1]; got != line {
+			t.Errorf("DumpAll line %d: got %q, want %q", idx+1, got, line)
+		}
+	}
+}
+
+func TestSortedGoroutines(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	for i := 0; i < 5; i++ {
+		done := make(chan struct{})
+		go func() {
+			tr.Trace(0)
+			close(done)
+		}()
+		<-done
+	}
+
+	sorted := tr.SortedGoroutines()
+	if got, want := len(sorted), 5; got != want {
+		t.Fatalf("got %d goroutines, want %d", got, want)
+	}
+	for idx := 1; idx < len(sorted); idx++ {
+		if sorted[idx-1].ID >= sorted[idx].ID {
+			t.Errorf("goroutines out of order: %d before %d", sorted[idx-1].ID, sorted[idx].ID)
+		}
+	}
+}
+
+func TestFrameMessages(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.FrameMessages = true
+	tr.OnGoroutineSwitchPrintStackHistory = false
+	tr.OnGoroutineSwitchPrintCurrentStack = true
+
+	tr.TraceFrames(functionFrames("main.a", "main.main"), "in a")
+	tr.TraceFrames(functionFrames("main.b", "main.a", "main.main"), "in b")
+	done := make(chan struct{})
+	go func() {
+		tr.TraceFrames(functionFrames("main.other"))
+		close(done)
+	}()
+	<-done
+	out.lines = nil
+	tr.TraceFrames(functionFrames("main.c", "main.b", "main.a", "main.main"), "in c")
+
+	want := []string{
+		" main.main()",
+		"   main.a() in a",
+		"     main.b() in b",
+		"+       main.c() in c",
+	}
+	if got := out.lines[1:]; len(got) != len(want) {
+		t.Fatalf("got lines %q, want suffixes %q", got, want)
+	}
+	for idx, line := range out.lines[1:] {
+		if !strings.HasSuffix(line, want[idx]) {
+			t.Errorf("line %d: got %q, want suffix %q", idx, line, want[idx])
+		}
+	}
+}
+
+func TestHotFunctions(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.HotThreshold = 3
+	for i := 0; i < 4; i++ {
+		done := make(chan struct{})
+		go func() {
+			traceHotSpot(tr)
+			close(done)
+		}()
+		<-done
+	}
+
+	hot := tr.HotFunctions(3)
+	if len(hot) != 1 {
+		t.Fatalf("got hot functions %v, want exactly one", hot)
+	}
+	for function, count := range hot {
+		if !strings.HasSuffix(function, ".traceHotSpot") || count != 4 {
+			t.Errorf("got hot function %q in %d goroutines, want traceHotSpot in 4", function, count)
+		}
+	}
+	if got := tr.HotFunctions(4); len(got) != 0 {
+		t.Errorf("HotFunctions(4): got %v, want none", got)
+	}
+
+	var hints int
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, "(hot: ") {
+			hints++
+		}
+	}
+	if hints != 1 {
+		t.Errorf("got %d inline hot hints, want 1", hints)
+	}
+}
+
+func traceHotSpot(tr *Tracer) {
+	tr.Trace(0)
+}
+
+func TestTreeReport(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	for _, frames := range [][]*FrameInfo{
+		functionFrames("main.b", "main.a", "main.main"),
+		functionFrames("main.c", "main.a", "main.main"),
+		functionFrames("main.e", "main.d", "main.main"),
+	} {
+		done := make(chan struct{})
+		go func(frames []*FrameInfo) {
+			tr.TraceFrames(frames)
+			close(done)
+		}(frames)
+		<-done
+	}
+
+	var report strings.Builder
+	tr.TreeReport(&report)
+	want := `main.main()
+├─ main.a()
+│  ├─ main.b()
+│  └─ main.c()
+└─ main.d()
+   └─ main.e()
+`
+	if got := report.String(); got != want {
+		t.Errorf("got report:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCollapsePatterns(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.CollapsePatterns = []*regexp.Regexp{regexp.MustCompile(`^mw\.`)}
+
+	tr.TraceFrames(functionFrames("main.handler", "mw.Auth", "mw.Log", "mw.Recover", "mw.Serve", "main.main"), "handling")
+
+	want := []string{
+		"+ main.main()",
+		"+   [4 frames matching ^mw\\.]",
+		"+           main.handler() handling",
+	}
+	if got := out.lines[1:]; len(got) != len(want) {
+		t.Fatalf("got lines %q, want suffixes %q", got, want)
+	}
+	for idx, line := range out.lines[1:] {
+		if !strings.HasSuffix(line, want[idx]) {
+			t.Errorf("line %d: got %q, want suffix %q", idx, line, want[idx])
+		}
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Predicate = func(goroutineID int) bool { return false }
+	tr.Trace(0, "rejected")
+	if len(out.lines) != 0 || tr.captures != 0 {
+		t.Errorf("rejected call: got %d lines and %d captures, want none", len(out.lines), tr.captures)
+	}
+
+	tr.Predicate = func(goroutineID int) bool { return goroutineID == GoroutineID() }
+	tr.Trace(0, "accepted")
+	if len(out.lines) == 0 || tr.captures != 1 {
+		t.Errorf("accepted call: got %d lines and %d captures, want output and 1 capture", len(out.lines), tr.captures)
+	}
+}
+
+func BenchmarkTraceRejectedByPredicate(b *testing.B) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.Predicate = func(goroutineID int) bool { return false }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.Trace(0)
+	}
+	b.ReportMetric(float64(tr.captures), "captures")
+	if tr.captures != 0 {
+		b.Fatalf("got %d captures, want 0", tr.captures)
+	}
+}
+
+func TestTraceRejectedByPredicateDoesNotAllocate(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.Predicate = func(goroutineID int) bool { return false }
+	if allocs := testing.AllocsPerRun(100, func() { tr.Trace(0) }); allocs != 0 {
+		t.Errorf("got %v allocations per rejected call, want 0", allocs)
+	}
+}
+
+func TestIndentationCacheBounded(t *testing.T) {
+	tr := &Tracer{}
+	for _, level := range []int{0, 3, maxCachedIndents - 1, maxCachedIndents, 10000} {
+		if got, want := tr.indentation(level), strings.Repeat("  ", level); got != want {
+			t.Errorf("level %d: got %d characters of indentation, want %d", level, len(got), len(want))
+		}
+	}
+	if got := len(tr.indents); got > maxCachedIndents {
+		t.Errorf("got %d cached indentations, want at most %d", got, maxCachedIndents)
+	}
+}
+
+func TestTraceLines(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Trace(0, "before")
+	before := len(out.lines)
+
+	lines := tr.TraceLines(0, "returned")
+	if got, want := lines, out.lines[before:]; len(got) == 0 || len(got) != len(want) {
+		t.Fatalf("got lines %q, want %q", got, want)
+	}
+	for idx, line := range lines {
+		if want := out.lines[before+idx]; line != want {
+			t.Errorf("line %d: got %q, want %q", idx, line, want)
+		}
+	}
+	if last := lines[len(lines)-1]; !strings.HasSuffix(last, "returned") {
+		t.Errorf("last line: got %q, want suffix %q", last, "returned")
+	}
+	if tr.collected != nil {
+		t.Errorf("lines still being collected after TraceLines returned")
+	}
+}
+
+func TestShowGoroutineState(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowGoroutineState = true
+
+	traced, release := make(chan int), make(chan struct{})
+	defer close(release)
+	go func() {
+		tr.Trace(0, "about to block")
+		traced <- GoroutineID()
+		<-release
+	}()
+	blocked := <-traced
+
+	// Each trace from a new goroutine is a goroutine switch, which
+	// captures the states. Retry until the blocked goroutine has
+	// actually reached its receive.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		done := make(chan struct{})
+		go func() {
+			tr.Trace(0)
+			close(done)
+		}()
+		<-done
+		if state := tr.Goroutines()[blocked].State; state == "chan receive" {
+			for _, line := range out.lines {
+				if strings.Contains(line, "goroutine switched") && strings.Contains(line, "] ->") {
+					return
+				}
+			}
+			t.Fatalf("no switch banner shows a goroutine state: %q", out.lines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("state of blocked goroutine: got %q, want %q", tr.Goroutines()[blocked].State, "chan receive")
+}
+
+func TestSetOn(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.On = false
+	tr.OmitTime = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), time.Second)
+
+	tr.SetOn(true)
+	tr.SetOn(true)
+	tr.Trace(0, "first")
+	done := make(chan struct{})
+	go func() {
+		tr.Trace(0, "second")
+		close(done)
+	}()
+	<-done
+	tr.SetOn(false)
+	tr.SetOn(false)
+
+	if got, want := out.lines[0], "=== tracing started ==="; got != want {
+		t.Errorf("first line: got %q, want %q", got, want)
+	}
+	wantLast := fmt.Sprintf("=== tracing stopped (%d lines, 2 goroutines, 3.0s) ===", len(out.lines)-2)
+	if got := out.lines[len(out.lines)-1]; got != wantLast {
+		t.Errorf("last line: got %q, want %q", got, wantLast)
+	}
+	var boundaries int
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, "===") {
+			boundaries++
+		}
+	}
+	if boundaries != 2 {
+		t.Errorf("got %d boundary lines, want 2", boundaries)
+	}
+}
+
+func TestClockReadFirst(t *testing.T) {
+	var events []string
+	tr := newTestTracer(&eventLogger{events: &events})
+	tr.ClockFn = func() time.Time {
+		events = append(events, "clock")
+		return time.Now()
+	}
+	tr.Trace(0)
+
+	if len(events) < 2 || events[0] != "clock" || events[1] != "output" {
+		t.Errorf("got events %q, want the clock read before any output", events)
+	}
+}
+
+// eventLogger is a Logger that records the word "output" in `events`
+// for every line written to it.
+type eventLogger struct {
+	events *[]string
+}
+
+func (el *eventLogger) Printf(format string, v ...interface{}) {
+	*el.events = append(*el.events, "output")
+}
+
+func (el *eventLogger) Println(v ...interface{}) {
+	*el.events = append(*el.events, "output")
+}
+
+func TestEscapeControl(t *testing.T) {
+	for _, tc := range []struct {
+		escape bool
+		want   string
+	}{
+		{true, `main.a() two\nlines\tand\x00more`},
+		{false, "main.a() two\nlines\tand\x00more"},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.EscapeControl = tc.escape
+		tr.TraceFrames(functionFrames("main.a"), "two\nlines\tand\x00more")
+		if got := out.lines[len(out.lines)-1]; !strings.HasSuffix(got, tc.want) {
+			t.Errorf("EscapeControl %v: got %q, want suffix %q", tc.escape, got, tc.want)
+		}
+	}
+}
+
+func TestOnStart(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.On = false
+	var starts int
+	tr.OnStart = func(*Tracer) { starts++ }
+
+	tr.Trace(0)
+	if starts != 0 {
+		t.Errorf("while off: got %d starts, want 0", starts)
+	}
+
+	tr.On = true
+	tr.Trace(0)
+	tr.Trace(0)
+	if starts != 1 {
+		t.Errorf("after turning on: got %d starts, want 1", starts)
+	}
+
+	tr.On = false
+	tr.Trace(0)
+	tr.On = true
+	tr.Trace(0)
+	if starts != 2 {
+		t.Errorf("after turning back on: got %d starts, want 2", starts)
+	}
+
+	tr.SetOn(false)
+	tr.SetOn(true)
+	tr.Trace(0)
+	if starts != 3 {
+		t.Errorf("after SetOn(false), SetOn(true): got %d starts, want 3", starts)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	first := functionFrames("main.a", "main.worker")
+	second := functionFrames("main.b", "main.server")
+	if fingerprint(17, first) != fingerprint(17, first) {
+		t.Errorf("fingerprint is not stable")
+	}
+	if fingerprint(17, first) == fingerprint(17, second) {
+		t.Errorf("goroutines sharing id 17 with different stacks got the same fingerprint")
+	}
+
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowFingerprint = true
+	tr.TraceFrames(first)
+	original := tr.Goroutines()[GoroutineID()].Fingerprint
+	if want := fingerprint(GoroutineID(), first); original != want {
+		t.Errorf("got fingerprint %q, want %q from the first stack", original, want)
+	}
+	tr.TraceFrames(second)
+	if got := tr.Goroutines()[GoroutineID()].Fingerprint; got != original {
+		t.Errorf("fingerprint changed from %q to %q within a goroutine", original, got)
+	}
+	if last := out.lines[len(out.lines)-1]; !strings.Contains(last, "#"+original+" ") {
+		t.Errorf("last line %q does not contain fingerprint %q", last, original)
+	}
+}
+
+func TestFingerprintWithTruncatedStacks(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.Capacity = 3
+	fingerprints := map[string]bool{}
+	for depth := 0; depth < 3; depth++ {
+		traceAtDepth(tr, depth)
+		fingerprints[tr.Goroutines()[GoroutineID()].Fingerprint] = true
+	}
+	if len(fingerprints) != 1 {
+		t.Errorf("got fingerprints %v for a single goroutine, want one", fingerprints)
+	}
+}
+
+// traceAtDepth traces with `depth` more frames on the stack than its
+// caller.
+func traceAtDepth(tr *Tracer, depth int) {
+	if depth > 0 {
+		traceAtDepth(tr, depth-1)
+		return
+	}
+	tr.Trace(0)
+}
+
+func TestGoroutineInfoString(t *testing.T) {
+	gi := &GoroutineInfo{
+		ID:         5,
+		Frames:     functionFrames("main.b", "main.a", "main.main"),
+		TopMessage: "x=3",
+	}
+	want := `goroutine 5:
+main.go:1 main.main()
+main.go:2   main.a()
+main.go:3     main.b() x=3
+`
+	if got := gi.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrintCreationStack(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.PrintCreationStack = true
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		go func() {
+			tr.Trace(0)
+			tr.Trace(0)
+			close(done)
+		}()
+		<-done
+	}
+
+	creations := make(map[int]int)
+	for id, goroutine := range tr.Goroutines() {
+		if !strings.HasPrefix(goroutine.CreatedBy, "created by ") || !strings.Contains(goroutine.CreatedBy, "trace_test.go:") {
+			t.Errorf("goroutine %d: got CreatedBy %q, want the creation site in trace_test.go", id, goroutine.CreatedBy)
+		}
+		for _, line := range out.lines {
+			if line == fmt.Sprintf("goroutine %d %s", id, goroutine.CreatedBy) {
+				creations[id]++
+			}
+		}
+	}
+	if len(creations) != 2 {
+		t.Errorf("got creation sites for %d goroutines, want 2", len(creations))
+	}
+	for id, count := range creations {
+		if count != 1 {
+			t.Errorf("goroutine %d: creation site printed %d times, want once", id, count)
+		}
+	}
+}
+
+func TestEnable(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.On = false
+
+	restoreOuter := tr.Enable()
+	if !tr.IsOn() {
+		t.Fatalf("On is false after Enable()")
+	}
+	restoreInner := tr.Enable()
+	restoreInner()
+	if !tr.IsOn() {
+		t.Errorf("inner restore turned off the outer scope")
+	}
+	restoreOuter()
+	if tr.IsOn() {
+		t.Errorf("outer restore did not turn tracing back off")
+	}
+
+	tr.SetOn(true)
+	tr.Enable()()
+	if !tr.IsOn() {
+		t.Errorf("restore turned off a Tracer that was already on")
+	}
+}
+
+func TestTimePrecision(t *testing.T) {
+	for _, tc := range []struct {
+		precision  TimePrecision
+		wantDigits int
+	}{
+		{TimeDefault, 8},
+		{TimeSeconds, 0},
+		{TimeMillis, 3},
+		{TimeMicros, 6},
+		{TimeNanos, 9},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.TimePrecision = tc.precision
+		tr.ClockFn = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 123456789, time.UTC) }
+		tr.TraceFrames(functionFrames("main.a"))
+
+		timestamp := strings.Fields(out.lines[len(out.lines)-1])[1]
+		var digits int
+		if dot := strings.Index(timestamp, "."); dot >= 0 {
+			digits = len(timestamp) - dot - 1
+		}
+		if digits != tc.wantDigits {
+			t.Errorf("precision %d: got time %q with %d fractional digits, want %d", tc.precision, timestamp, digits, tc.wantDigits)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	counter := 1
+	w := tr.Watch("counter", &counter)
+
+	if w.Check() || len(out.lines) != 0 {
+		t.Fatalf("unchanged value: got output %q", out.lines)
+	}
+	counter = 2
+	if !w.Check() {
+		t.Errorf("changed value: Check() returned false")
+	}
+	if got, want := out.lines[len(out.lines)-1], "counter changed: 1 -> 2"; !strings.HasSuffix(got, want) {
+		t.Errorf("changed value: got line %q, want suffix %q", got, want)
+	}
+	if !strings.Contains(out.lines[len(out.lines)-1], ".TestWatch()") {
+		t.Errorf("changed value: line %q is not attributed to the caller of Check()", out.lines[len(out.lines)-1])
+	}
+	before := len(out.lines)
+	if w.Check() || len(out.lines) != before {
+		t.Errorf("unchanged value after change: got output %q", out.lines[before:])
+	}
+}
+
+func TestHistoryByKey(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.TraceKey("db", "query 1")
+	tr.TraceKey("cache", "lookup")
+	tr.Trace(0, "unkeyed")
+	tr.TraceKey("db", "query 2")
+
+	db := tr.HistoryByKey("db")
+	if len(db) < 2 {
+		t.Fatalf("got db history %q, want at least 2 lines", db)
+	}
+	for _, line := range db {
+		if strings.Contains(line, "lookup") || strings.Contains(line, "unkeyed") {
+			t.Errorf("db history contains line %q", line)
+		}
+	}
+	if got := db[len(db)-2]; !strings.HasSuffix(got, "query 1") {
+		t.Errorf("second to last db line: got %q, want suffix %q", got, "query 1")
+	}
+	if last := db[len(db)-1]; !strings.HasSuffix(last, "query 2") {
+		t.Errorf("last db line: got %q, want suffix %q", last, "query 2")
+	}
+	if cache := tr.HistoryByKey("cache"); len(cache) != 1 || !strings.HasSuffix(cache[0], "lookup") {
+		t.Errorf("got cache history %q, want a single lookup line", cache)
+	}
+}
+
+func TestAutomaticSkip(t *testing.T) {
+	out := &recordingLogger{}
+	defer SetGlobal(GetGlobal())
+	SetGlobal(newTestTracer(out))
+	counter := 0
+	watcher := Watch("counter", &counter)
+
+	for _, tc := range []struct {
+		label string
+		trace func()
+		want  string
+	}{
+		{"Trace", func() { Trace("direct") }, ".TestAutomaticSkip.func"},
+		{"Assert", func() { Assert(false, "assert") }, ".TestAutomaticSkip.func"},
+		{"Watch", func() { counter++; watcher.Check() }, ".TestAutomaticSkip.func"},
+		{"wrapper", func() { traceWrapper(GetGlobal(), "wrapped") }, ".TestAutomaticSkip.func"},
+		{"Trace(0) in wrapper", func() { traceUnskipped(GetGlobal()) }, ".traceUnskipped"},
+	} {
+		tc.trace()
+		frames := GetGlobal().Goroutines()[GoroutineID()].Frames
+		if top := frames[0].Function; !strings.Contains(top, tc.want) {
+			t.Errorf("%s: got top frame %q, want %q", tc.label, top, tc.want)
+		}
+	}
+}
+
+// traceWrapper traces on behalf of its caller.
+func traceWrapper(tr *Tracer, args ...interface{}) {
+	tr.Trace(1, args...)
+}
+
+// traceUnskipped traces itself.
+func traceUnskipped(tr *Tracer) {
+	tr.Trace(0)
+}
+
+func TestFrameInfoJSON(t *testing.T) {
+	want := &FrameInfo{
+		Frame: runtime.Frame{
+			Function: "main.a",
+			File:     "/src/main.go",
+			Line:     12,
+			PC:       0x1234,
+			Entry:    0x1200,
+		},
+		TimeRecorded: time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC),
+		Message:      "x=3",
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	got := &FrameInfo{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("round trip through %s: got %+v, want %+v", data, got, want)
+	}
+}
+
+func TestFlightRecorder(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.FlightRecorder(3)
+	for i := 0; i < 10; i++ {
+		tr.TraceFrames(functionFrames("main.a", "main.main"), "call %d", i)
+	}
+	if len(out.lines) != 0 {
+		t.Errorf("got live output %q, want none", out.lines)
+	}
+
+	var dump strings.Builder
+	tr.DumpFlightRecorder(&dump)
+	lines := strings.Split(strings.TrimSuffix(dump.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got dump %q, want 3 lines", lines)
+	}
+	for idx, line := range lines {
+		if want := fmt.Sprintf("call %d", 7+idx); !strings.HasSuffix(line, want) {
+			t.Errorf("dump line %d: got %q, want suffix %q", idx, line, want)
+		}
+	}
+	if history := tr.History(); len(history) != 0 {
+		t.Errorf("got history %q, want none in flight recorder mode", history)
+	}
+
+	tr.FlightRecorder(0)
+	if tr.SilentCapture {
+		t.Errorf("SilentCapture still set after turning the flight recorder off")
+	}
+	tr.SilentCapture = true
+	tr.FlightRecorder(3)
+	tr.FlightRecorder(0)
+	if !tr.SilentCapture {
+		t.Errorf("turning the flight recorder off cleared SilentCapture set before it")
+	}
+}
+
+func TestTags(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Tags = map[string]string{"ver": "1.2", "svc": "checkout"}
+	tr.TraceFrames(functionFrames("main.b", "main.a"), "message")
+	tr.TraceFrames(functionFrames("main.c", "main.a"))
+
+	for _, line := range out.lines[1:] {
+		if !strings.HasSuffix(line, " svc=checkout ver=1.2") {
+			t.Errorf("line %q does not end with the sorted tags", line)
+		}
+	}
+	for idx, want := range []string{" main.a() svc=checkout ver=1.2", " main.b() message svc=checkout ver=1.2"} {
+		if got := out.lines[idx+1]; !strings.HasSuffix(got, want) {
+			t.Errorf("line %d: got %q, want suffix %q", idx+1, got, want)
+		}
+	}
+}
+
+func TestEmptyCapture(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Trace(1000, "beyond the bottom of the stack")
+	tr.TraceFrames(nil, "no frames")
+
+	if len(out.lines) != 0 {
+		t.Errorf("got output %q, want none", out.lines)
+	}
+	if got := tr.Goroutines(); len(got) != 0 {
+		t.Errorf("got %d goroutines recorded, want none", len(got))
+	}
+	if got := getFrameInfos(1000, 10, time.Now()); len(got) != 0 {
+		t.Errorf("getFrameInfos beyond the bottom of the stack: got %d frames, want none", len(got))
+	}
+}
+
+func TestTraceDeep(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.Capacity = 2
+	depth := func() int { return len(tr.Goroutines()[GoroutineID()].Frames) }
+
+	recurse(10, func() { tr.Trace(0) })
+	if got := depth(); got != 2 {
+		t.Errorf("Trace: got %d frames, want 2", got)
+	}
+	recurse(10, func() { tr.TraceDeep(50) })
+	if got := depth(); got <= 10 {
+		t.Errorf("TraceDeep: got %d frames, want more than 10", got)
+	}
+}
+
+// recurse calls `fn` at a stack depth `n` frames below its caller.
+func recurse(n int, fn func()) {
+	if n == 0 {
+		fn()
+		return
+	}
+	recurse(n-1, fn)
+}
+
+func TestTraceEnter(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), time.Second)
+
+	for _, tc := range []struct {
+		result []interface{}
+		want   string
+	}{
+		{[]interface{}{"-> %d rows", 3}, "exit load users: -> 3 rows (2.0s)"},
+		{nil, "exit load users (2.0s)"},
+	} {
+		done := tr.TraceEnter("load %s", "users")
+		if got, want := out.lines[len(out.lines)-1], "enter load users"; !strings.HasSuffix(got, want) {
+			t.Errorf("entry line: got %q, want suffix %q", got, want)
+		}
+		done(tc.result...)
+		if got := out.lines[len(out.lines)-1]; !strings.HasSuffix(got, tc.want) {
+			t.Errorf("exit line: got %q, want suffix %q", got, tc.want)
+		}
+		if got := out.lines[len(out.lines)-1]; !strings.Contains(got, ".TestTraceEnter()") {
+			t.Errorf("exit line %q is not attributed to the traced function", got)
+		}
+	}
+}
+
+func TestShareSwitchesByOut(t *testing.T) {
+	out := &recordingLogger{}
+	first, second := newTestTracer(out), newTestTracer(out)
+	first.ShareSwitchesByOut = true
+	second.ShareSwitchesByOut = true
+
+	first.Trace(0, "first")
+	second.Trace(0, "second")
+	var other int
+	done := make(chan struct{})
+	go func() {
+		other = GoroutineID()
+		first.Trace(0, "other goroutine")
+		close(done)
+	}()
+	<-done
+	second.Trace(0, "second again")
+
+	var banners []string
+	for _, line := range out.lines {
+		if strings.Contains(line, "goroutine switched") {
+			banners = append(banners, strings.Join(strings.Fields(line)[3:6], " "))
+		}
+	}
+	me := GoroutineID()
+	want := []string{
+		fmt.Sprintf("0 -> %d", me),
+		fmt.Sprintf("%d -> %d", me, other),
+		fmt.Sprintf("%d -> %d", other, me),
+	}
+	if fmt.Sprint(banners) != fmt.Sprint(want) {
+		t.Errorf("got switches %q, want %q", banners, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.DedupeConsecutive = true
+	for i := 0; i < 3; i++ {
+		tr.TraceFrames(functionFrames("main.poll", "main.main"), "polling")
+	}
+	tr.TraceFrames(functionFrames("main.done", "main.main"))
+
+	stats := tr.Stats()
+	if stats.Lines != len(out.lines) {
+		t.Errorf("Lines: got %d, want %d", stats.Lines, len(out.lines))
+	}
+	if stats.Dropped != 2 {
+		t.Errorf("Dropped: got %d, want 2", stats.Dropped)
+	}
+	if stats.Goroutines != 1 {
+		t.Errorf("Goroutines: got %d, want 1", stats.Goroutines)
+	}
+	if got := stats.Functions["main.poll"]; got != 3 {
+		t.Errorf("Functions[main.poll]: got %d, want 3", got)
+	}
+	if got := stats.Functions["main.done"]; got != 1 {
+		t.Errorf("Functions[main.done]: got %d, want 1", got)
+	}
+
+	for i := 0; i < maxStatsFunctions+5; i++ {
+		tr.TraceFrames(functionFrames(fmt.Sprintf("main.f%d", i)))
+	}
+	stats = tr.Stats()
+	if len(stats.Functions) != maxStatsFunctions+1 {
+		t.Errorf("got %d distinct functions, want %d", len(stats.Functions), maxStatsFunctions+1)
+	}
+	if got := stats.Functions[otherFunctions]; got != 7 {
+		t.Errorf("Functions[%s]: got %d, want 7", otherFunctions, got)
+	}
+}
+
+func TestExpandInline(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ExpandInline = true
+	traceInlined(tr)
+
+	frames := tr.Goroutines()[GoroutineID()].Frames
+	if len(frames) < 2 || !strings.HasSuffix(frames[0].Function, ".traceInlined") {
+		t.Fatalf("got top frame %v, want traceInlined", frames[0])
+	}
+	if !frames[0].Inlined {
+		t.Skip("traceInlined was not inlined in this build")
+	}
+	if frames[1].Inlined {
+		t.Errorf("caller %s: got Inlined, want not inlined", frames[1].Function)
+	}
+	top := out.lines[len(out.lines)-1]
+	if !strings.Contains(top, "traceInlined() (inlined)") {
+		t.Errorf("got top line %q, want inline marker", top)
+	}
+	if strings.Contains(out.lines[len(out.lines)-2], "(inlined)") {
+		t.Errorf("got caller line %q, want no inline marker", out.lines[len(out.lines)-2])
+	}
+}
+
+// traceInlined is small enough to be inlined into its caller.
+func traceInlined(tr *Tracer) {
+	tr.Trace(0)
+}
+
+func TestTraceErrStack(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+
+	err := failDeep()
+	tr.TraceErrStack(err, "loading %s", "config")
+	top := out.lines[len(out.lines)-1]
+	if !strings.Contains(top, ".newStackError()") || !strings.HasSuffix(top, "loading config: disk full") {
+		t.Errorf("got top line %q, want newStackError with the error", top)
+	}
+	var sawFailDeep, sawTest bool
+	for _, line := range out.lines {
+		sawFailDeep = sawFailDeep || strings.Contains(line, ".failDeep()")
+		sawTest = sawTest || strings.Contains(line, ".TestTraceErrStack()")
+	}
+	if !sawFailDeep || !sawTest {
+		t.Errorf("got lines %q, want both the error's frames and the current ones", out.lines)
+	}
+
+	out.lines = nil
+	tr.TraceErrStack(fmt.Errorf("plain"))
+	top = out.lines[len(out.lines)-1]
+	if !strings.Contains(top, ".TestTraceErrStack()") || !strings.HasSuffix(top, "plain") {
+		t.Errorf("plain error: got top line %q, want the current frame with the error", top)
+	}
+
+	out.lines = nil
+	tr.TraceErrStack(nil)
+	if len(out.lines) != 0 {
+		t.Errorf("nil error: got lines %q, want none", out.lines)
+	}
+
+	tr.On = false
+	counting := &countingError{}
+	tr.TraceErrStack(counting)
+	if counting.calls != 0 {
+		t.Errorf("tracing off: Error() called %d times, want 0", counting.calls)
+	}
+}
+
+// countingError is an error counting the calls to its Error() method.
+type countingError struct {
+	calls int
+}
+
+func (err *countingError) Error() string {
+	err.calls++
+	return "counted"
+}
+
+// stackError is an error carrying the stack at which it was created,
+// like the errors of github.com/pkg/errors.
+type stackError struct {
+	pcs []uintptr
+}
+
+func (err *stackError) Error() string         { return "disk full" }
+func (err *stackError) StackTrace() []uintptr { return err.pcs }
+
+func failDeep() error {
+	return newStackError()
+}
+
+func newStackError() error {
+	pcs := make([]uintptr, 32)
+	return &stackError{pcs: pcs[:runtime.Callers(1, pcs)]}
+}
+
+func TestReserveTimeColumn(t *testing.T) {
+	for _, precision := range []TimePrecision{TimeDefault, TimeSeconds, TimeNanos} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.TimePrecision = precision
+		tr.ReserveTimeColumn = true
+		tr.TraceFrames(functionFrames("main.work", "main.main"))
+		timed := out.lines[len(out.lines)-1]
+		tr.OmitTime = true
+		tr.TraceFrames(functionFrames("main.work", "main.main"))
+		untimed := out.lines[len(out.lines)-1]
+
+		if got, want := strings.Index(untimed, "main.work()"), strings.Index(timed, "main.work()"); got != want {
+			t.Errorf("precision %d: got function column %d in %q, want %d as in %q", precision, got, untimed, want, timed)
+		}
+	}
+}
+
+func TestFixedClock(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := FixedClock(start, 250*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		if got, want := clock(), start.Add(time.Duration(i)*250*time.Millisecond); !got.Equal(want) {
+			t.Errorf("call %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSwitchBannerThrottle(t *testing.T) {
+	for _, tc := range []struct {
+		throttle, banners, short int
+		resetStats               bool
+	}{
+		{throttle: 0, banners: 7, short: 0},
+		{throttle: 10, banners: 2, short: 5},
+		// ResetStats does not affect the throttle.
+		{throttle: 1, banners: 7, short: 0, resetStats: true},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.OmitTime = true
+		tr.SwitchBannerThrottle = tc.throttle
+
+		// The main goroutine and a consumer take turns three times.
+		ping, pong := make(chan bool), make(chan bool)
+		var consumer int
+		go func() {
+			consumer = GoroutineID()
+			for range ping {
+				tr.TraceFrames(functionFrames("main.consume"))
+				pong <- true
+			}
+		}()
+		for i := 0; i < 3; i++ {
+			if tc.resetStats {
+				tr.ResetStats()
+			}
+			tr.TraceFrames(functionFrames("main.produce"))
+			ping <- true
+			<-pong
+		}
+		close(ping)
+		tr.TraceFrames(functionFrames("main.produce"))
+
+		var banners, short int
+		for _, line := range out.lines {
+			if strings.Contains(line, "goroutine switched") {
+				banners++
+			}
+			if line == fmt.Sprintf("g%d>", consumer) || line == fmt.Sprintf("g%d>", GoroutineID()) {
+				short++
+			}
+		}
+		if banners != tc.banners || short != tc.short {
+			t.Errorf("throttle %d: got %d banners and %d short ones, want %d and %d", tc.throttle, banners, short, tc.banners, tc.short)
+		}
+	}
+}
+
+func TestPrintTo(t *testing.T) {
+	out, report := &recordingLogger{}, &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Trace(0, "first")
+	tr.Trace(0, "second")
+	written, stats := len(out.lines), tr.Stats()
+
+	tr.PrintTo(report)
+	if tr.Out != out || len(out.lines) != written {
+		t.Errorf("PrintTo changed Out or wrote %d lines to it", len(out.lines)-written)
+	}
+	if got := tr.Stats(); got.Lines != stats.Lines {
+		t.Errorf("PrintTo changed Stats().Lines from %d to %d", stats.Lines, got.Lines)
+	}
+	history := tr.Goroutines()[GoroutineID()].History
+	if got, want := len(report.lines), len(history)+1; got != want {
+		t.Fatalf("PrintTo wrote %d lines, want %d", got, want)
+	}
+	for idx, line := range history {
+		if got := report.lines[idx+1]; got != line {
+			t.Errorf("PrintTo line %d: got %q, want %q", idx+1, got, line)
+		}
+	}
+}
+
+func TestConfigureWhileTracing(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				tr.Trace(0, "working")
+			}
+		}()
+	}
+	// Run with -race to check that changing the configuration, turning
+	// tracing on and off, or replacing Out while other goroutines trace
+	// is not a data race.
+	for i := 0; i < 50; i++ {
+		tr.SetOn(i%2 == 1)
+		if err := tr.SetOut(&recordingLogger{}); err != nil {
+			t.Fatal(err)
+		}
+		tr.Configure(func(tr *Tracer) {
+			tr.OmitTime = !tr.OmitTime
+			tr.SourceLength = 20 + i
+			tr.ShowFrameAge = i%2 == 0
+			tr.ShowAllocs = i%2 == 1
+			tr.Tags = map[string]string{"round": fmt.Sprint(i)}
+		})
+	}
+	wg.Wait()
+
+	var sourceLength int
+	tr.Configure(func(tr *Tracer) { sourceLength = tr.SourceLength })
+	if sourceLength != 69 {
+		t.Errorf("got SourceLength %d, want the last one set, 69", sourceLength)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	reportCaller(tr)
+
+	if len(out.lines) != 1 {
+		t.Fatalf("got lines %q, want exactly one", out.lines)
+	}
+	line := out.lines[0]
+	if !strings.Contains(line, "trace_test.go:") || !strings.HasSuffix(line, ".TestCaller() called 100%") {
+		t.Errorf("got %q, want the location and name of TestCaller with the message", line)
+	}
+	if got := len(tr.Goroutines()); got != 0 {
+		t.Errorf("got %d goroutines recorded, want none", got)
+	}
+}
+
+func TestVariantsMeasureOverhead(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.MeasureOverhead = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+	reportCaller(tr)
+	tr.TraceFrames(functionFrames("main.a", "main.main"))
+	if got, want := tr.Overhead(), 2*time.Second; got != want {
+		t.Errorf("got overhead %v, want %v from Caller and TraceFrames", got, want)
+	}
+}
+
+// reportCaller prints the function that called it.
+func reportCaller(tr *Tracer) {
+	tr.Caller("called %d%%", 100)
+}
+
+func TestLogfmt(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Logfmt = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+	tr.Tags = map[string]string{"service": "my app"}
+	tr.TraceFrames(functionFrames("main.work", "main.main"), "say \"x=1\" now")
+
+	fields := parseLogfmt(t, out.lines[len(out.lines)-1])
+	want := map[string]string{
+		"ts":      "2018-01-02T03:04:05Z",
+		"g":       fmt.Sprint(GoroutineID()),
+		"level":   "1",
+		"func":    "main.work",
+		"file":    "main.go:2",
+		"new":     "true",
+		"msg":     `say "x=1" now`,
+		"service": "my app",
+	}
+	if fmt.Sprint(fields) != fmt.Sprint(want) {
+		t.Errorf("got fields %v, want %v", fields, want)
+	}
+}
+
+// parseLogfmt splits a logfmt `line` into its keys and values,
+// unquoting quoted values.
+func parseLogfmt(t *testing.T, line string) map[string]string {
+	fields := make(map[string]string)
+	for line != "" {
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			t.Fatalf("missing '=' in %q", line)
+		}
+		key, rest := line[:eq], line[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				t.Fatalf("bad quoted value in %q: %v", rest, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else if space := strings.IndexByte(rest, ' '); space >= 0 {
+			value, rest = rest[:space], rest[space:]
+		} else {
+			value, rest = rest, ""
+		}
+		fields[key] = value
+		line = strings.TrimPrefix(rest, " ")
+	}
+	return fields
+}
+
+func TestLockToCurrent(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.LockToCurrent()
+	traceElsewhere := func(message string) {
+		done := make(chan struct{})
+		go func() {
+			tr.Trace(0, message)
+			close(done)
+		}()
+		<-done
+	}
+
+	tr.Trace(0, "pinned")
+	traceElsewhere("ignored")
+	tr.Trace(0, "pinned again")
+	for _, line := range out.lines {
+		if strings.Contains(line, "ignored") || strings.Contains(line, "goroutine switched: ") && !strings.Contains(line, " 0 -> ") {
+			t.Errorf("got line %q from another goroutine while pinned", line)
+		}
+	}
+	if got := len(tr.Goroutines()); got != 1 {
+		t.Errorf("got %d goroutines recorded, want 1", got)
+	}
+
+	tr.Unlock()
+	traceElsewhere("after unlock")
+	if got := out.lines[len(out.lines)-1]; !strings.HasSuffix(got, "after unlock") {
+		t.Errorf("after Unlock: got last line %q, want the other goroutine's", got)
+	}
+}
+
+func TestHistorySummary(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.HistorySummary = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), 1500*time.Millisecond)
+	tr.TraceFrames(functionFrames("main.a", "main.main"))
+	tr.TraceFrames(functionFrames("main.b", "main.a", "main.main"))
+	tr.TraceFrames(functionFrames("main.c", "main.main"))
+
+	out.lines = nil
+	tr.DumpAll()
+	want := fmt.Sprintf("(goroutine %d: 4 frames recorded in 3.0s, max depth 3)", GoroutineID())
+	if got := out.lines[len(out.lines)-1]; got != want {
+		t.Errorf("got footer %q, want %q", got, want)
+	}
+}
+
+func TestNegativeSourceLength(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.SourceLength = -5
+	tr.OmitTime = true
+	tr.TraceFrames(functionFrames("main.work", "main.main"), "%s", "100% done")
+
+	want := []string{"main.main()", "  main.work() 100% done"}
+	got := out.lines[len(out.lines)-2:]
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func TestTraceAt(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ClockFn = func() time.Time {
+		t.Errorf("ClockFn called, want the supplied time used")
+		return time.Now()
+	}
+	at := time.Date(2018, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	tr.TraceAt(at, 0, "replayed")
+
+	frames := tr.Goroutines()[GoroutineID()].Frames
+	if !frames[0].TimeRecorded.Equal(at) || !strings.HasSuffix(frames[0].Function, ".TestTraceAt") {
+		t.Errorf("got top frame %s at %v, want TestTraceAt at %v", frames[0].Function, frames[0].TimeRecorded, at)
+	}
+	if got, want := out.lines[len(out.lines)-1], "2018-01-02 03:04:05.12345678 "; !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+}
+
+func TestEpochTime(t *testing.T) {
+	at := time.Date(2018, 1, 2, 3, 4, 5, 6789, time.UTC)
+	for _, logfmt := range []bool{false, true} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.EpochTime = true
+		tr.Logfmt = logfmt
+		tr.ClockFn = func() time.Time { return at }
+		tr.Trace(0)
+
+		want := "1514862245.000006789 "
+		if logfmt {
+			want = "ts=" + want
+		}
+		if got := out.lines[len(out.lines)-1]; !strings.HasPrefix(got, want) {
+			t.Errorf("logfmt %t: got %q, want prefix %q", logfmt, got, want)
+		}
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.MeasureOverhead = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), time.Millisecond)
+	for i := 0; i < 3; i++ {
+		tr.Trace(0)
+	}
+	// Each trace reads the clock on entry and on exit.
+	if got, want := tr.Overhead(), 3*time.Millisecond; got != want {
+		t.Errorf("got overhead %v, want %v", got, want)
+	}
+	if got := tr.Stats().Overhead; got != tr.Overhead() {
+		t.Errorf("got Stats().Overhead %v, want %v", got, tr.Overhead())
+	}
+
+	tr.ResetStats()
+	if got := tr.Overhead(); got != 0 {
+		t.Errorf("after ResetStats: got overhead %v, want 0", got)
+	}
+}
+
+func TestCollapseRepeats(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	tr.CollapseRepeats = true
+	frames := functionFrames("main.leaf", "main.walk", "main.walk", "main.walk", "main.walk", "main.main")
+	for idx, frame := range frames {
+		frame.PC = uintptr(100 + idx)
+		if frame.Function == "main.walk" {
+			frame.PC, frame.Line = 7, 7
+		}
+	}
+	// A different call site of the same function is kept separate.
+	frames[1].PC, frames[1].Line = 8, 8
+	tr.TraceFrames(frames)
+
+	// Indentation still reflects the depth of each frame.
+	want := []string{"main.main()", "  main.walk() (x3)", "        main.walk()", "          main.leaf()"}
+	if got := out.lines[len(out.lines)-len(want):]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func BenchmarkTraceSynchronized(b *testing.B) {
+	benchmarkTrace(b, false)
+}
+
+func BenchmarkTraceUnsynchronized(b *testing.B) {
+	benchmarkTrace(b, true)
+}
+
+func benchmarkTrace(b *testing.B, unsynchronized bool) {
+	tr := newTestTracer(log.New(ioutil.Discard, "", 0))
+	tr.Unsynchronized = unsynchronized
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.Trace(0)
+	}
+}
+
+// TestUnsynchronized only checks single-goroutine use: using an
+// Unsynchronized Tracer from several goroutines is a data race, which
+// avoiding is the caller's responsibility.
+func TestUnsynchronized(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Unsynchronized = true
+	tr.Trace(0, "first")
+	tr.Trace(0, "second")
+	if got := out.lines[len(out.lines)-1]; !strings.HasSuffix(got, "second") {
+		t.Errorf("got last line %q, want suffix %q", got, "second")
+	}
+	if got := len(tr.Goroutines()); got != 1 {
+		t.Errorf("got %d goroutines recorded, want 1", got)
+	}
+}
+
+func TestTraceAsync(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	for i := 0; i < 3; i++ {
+		tr.TraceAsync(0, "capture %d", i)
+	}
+	done := make(chan struct{})
+	go func() {
+		tr.TraceAsync(0, "elsewhere")
+		close(done)
+	}()
+	<-done
+	tr.Flush()
+
+	out.mutex.Lock()
+	var messages []string
+	for _, line := range out.lines {
+		if idx := strings.Index(line, "() "); idx >= 0 && !strings.Contains(line, "goroutine switched") {
+			messages = append(messages, line[idx+3:])
+		}
+	}
+	out.lines = nil
+	out.mutex.Unlock()
+	want := []string{"capture 0", "capture 1", "capture 2", "elsewhere"}
+	if fmt.Sprint(messages) != fmt.Sprint(want) {
+		t.Errorf("got messages %q, want %q", messages, want)
+	}
+	frames := tr.Goroutines()[GoroutineID()].Frames
+	if len(frames) == 0 || !strings.HasSuffix(frames[0].Function, ".TestTraceAsync") {
+		t.Errorf("got top frame %v, want TestTraceAsync", frames)
+	}
+
+	// Captures still queued when tracing is turned off are dropped.
+	tr.mutex.Lock()
+	tr.TraceAsync(0, "queued")
+	atomic.StoreInt32(&tr.onState, onStateOff)
+	tr.mutex.Unlock()
+	tr.Flush()
+	if len(out.lines) != 0 {
+		t.Errorf("got lines %q written after tracing was turned off", out.lines)
+	}
+
+	tr.SetOn(false)
+	if tr.asyncQueue != nil {
+		t.Errorf("background goroutine still running after SetOn(false)")
+	}
+	other := newTestTracer(&recordingLogger{})
+	other.Flush()
+	if other.asyncQueue != nil {
+		t.Errorf("Flush started a background goroutine without TraceAsync")
+	}
+}
+
+func BenchmarkTraceAsync(b *testing.B) {
+	tr := newTestTracer(log.New(ioutil.Discard, "", 0))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.TraceAsync(0)
+	}
+	tr.Flush()
+}
+
+func TestReplayCallout(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	tr.OnGoroutineSwitchPrintStackHistory = true
+	tr.ReplayCallout = '~'
+	tr.TraceFrames(functionFrames("main.work", "main.main"), "before")
+	done := make(chan struct{})
+	go func() {
+		tr.TraceFrames(functionFrames("main.other"))
+		close(done)
+	}()
+	<-done
+	out.lines = nil
+	tr.TraceFrames(functionFrames("main.next", "main.main"), "after")
+
+	want := []string{"~ main.main()", "~   main.work() before", "  main.next() after"}
+	if got := out.lines[1:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func TestTopFunction(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	traceHotSpot(tr)
+	function, ok := tr.TopFunction(GoroutineID())
+	if !ok || !strings.HasSuffix(function, ".traceHotSpot") {
+		t.Errorf("got (%q, %t), want traceHotSpot", function, ok)
+	}
+	if function, ok := tr.TopFunction(-1); ok || function != "" {
+		t.Errorf("unknown goroutine: got (%q, %t), want (\"\", false)", function, ok)
+	}
+}
+
+func TestLocationTruncation(t *testing.T) {
+	tr := &Tracer{SourceLength: 28}
+	for _, tc := range []struct {
+		file, want string
+	}{
+		{file: `C:\work\src\pkg\foo.go`, want: `  …\pkg\foo.go:42  p7 g3  %c`},
+		{file: "/home/用户/代码/main.go", want: "  …/代码/main.go:42  p7 g3  %c"},
+		{file: "/a/very_long_file_name.go", want: "…_file_name.go:42  p7 g3  %c"},
+		{file: "main.go", want: "     main.go:42    p7 g3  %c"},
+	} {
+		frame := &FrameInfo{Frame: runtime.Frame{File: tc.file, Line: 42, PC: 7}}
+		got := tr.location(frame, 3)
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.file, got, tc.want)
+		}
+		if n := utf8.RuneCountInString(got); n != tr.SourceLength {
+			t.Errorf("%s: got %d runes, want %d", tc.file, n, tr.SourceLength)
+		}
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.CoalesceWindow = 10 * time.Microsecond
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Three calls within the window form a single block, written
+	// when a call falls outside the window.
+	for i := 0; i < 3; i++ {
+		tr.TraceAt(start.Add(time.Duration(i)*2*time.Microsecond), 0, "burst %d", i)
+	}
+	if len(out.lines) != 0 {
+		t.Fatalf("got lines %q within the window, want none", out.lines)
+	}
+	tr.TraceAt(start.Add(time.Millisecond), 0, "later")
+	if len(out.lines) != 1 {
+		t.Fatalf("got %d writes after the window, want 1", len(out.lines))
+	}
+	block := out.lines[0]
+	for i := 0; i < 3; i++ {
+		if !strings.Contains(block, fmt.Sprintf("burst %d", i)) {
+			t.Errorf("block %q is missing burst %d", block, i)
+		}
+	}
+	if strings.Contains(block, "later") {
+		t.Errorf("block %q includes the call after the window", block)
+	}
+
+	// Another goroutine ends the window too.
+	done := make(chan struct{})
+	go func() {
+		tr.TraceAt(start.Add(time.Millisecond+time.Microsecond), 0, "elsewhere")
+		close(done)
+	}()
+	<-done
+	if len(out.lines) != 2 || !strings.HasSuffix(out.lines[1], "later") {
+		t.Errorf("got writes %q, want the block ending in \"later\" written", out.lines)
+	}
+	tr.Flush()
+	if len(out.lines) != 3 || !strings.HasSuffix(out.lines[2], "elsewhere") {
+		t.Errorf("after Flush: got writes %q, want the last block written", out.lines)
+	}
+}
+
+func TestShowAllocs(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowAllocs = true
+	tr.Trace(0, "before")
+	if got := out.lines[len(out.lines)-1]; strings.Contains(got, "allocs") {
+		t.Errorf("first call: got %q, want no allocation count", got)
+	}
+	allocSink = make([][]byte, 1000)
+	for i := range allocSink {
+		allocSink[i] = make([]byte, 1024)
+	}
+	tr.Trace(0, "after")
+
+	re := regexp.MustCompile(`after \+(\d+) allocs$`)
+	match := re.FindStringSubmatch(out.lines[len(out.lines)-1])
+	if match == nil {
+		t.Fatalf("got %q, want suffix matching %q", out.lines[len(out.lines)-1], re)
+	}
+	if allocs, _ := strconv.Atoi(match[1]); allocs < len(allocSink) {
+		t.Errorf("got %d allocs, want at least %d", allocs, len(allocSink))
+	}
+}
+
+// allocSink keeps the allocations of TestShowAllocs on the heap.
+var allocSink [][]byte
+
+func TestContextFrames(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.ContextFrames = 2
+	tr.TraceFrames(functionFrames("main.d", "main.c", "main.b", "main.a", "main.main"))
+	out.lines = nil
+	tr.TraceFrames(functionFrames("main.f", "main.e", "main.c", "main.b", "main.a", "main.main"))
+
+	want := []string{"main.b()", "main.c()", "main.e()", "main.f()"}
+	if len(out.lines) != len(want) {
+		t.Fatalf("got lines %q, want %d", out.lines, len(want))
+	}
+	for idx, line := range out.lines {
+		if !strings.HasSuffix(line, want[idx]) {
+			t.Errorf("line %d: got %q, want suffix %q", idx, line, want[idx])
+		}
+		// Only the last two frames are new.
+		if isNew, wantNew := strings.Contains(line, "+"), idx >= 2; isNew != wantNew {
+			t.Errorf("line %d: got %q, want new %t", idx, line, wantNew)
+		}
+	}
+}
+
+func TestRecentBuffer(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.RecentBuffer(3)
+	if got := tr.Recent(); len(got) != 0 {
+		t.Errorf("before tracing: got %q, want no lines", got)
+	}
+	tr.Trace(0, "first")
+	done := make(chan struct{})
+	go func() {
+		tr.Trace(0, "other goroutine")
+		close(done)
+	}()
+	<-done
+	tr.Trace(0, "last")
+
+	if got, want := tr.Recent(), out.lines[len(out.lines)-3:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got recent lines %q, want %q", got, want)
+	}
+	tr.RecentBuffer(0)
+	tr.Trace(0, "untracked")
+	if got := tr.Recent(); len(got) != 0 {
+		t.Errorf("after RecentBuffer(0): got %q, want no lines", got)
+	}
+}
+
+func TestSetOut(t *testing.T) {
+	first := &recordingLogger{}
+	tr := newTestTracer(first)
+	if err := tr.SetOut(nil); err == nil {
+		t.Error("SetOut(nil): got no error")
+	}
+	var nilLogger *recordingLogger
+	if err := tr.SetOut(nilLogger); err == nil {
+		t.Error("SetOut(nil pointer): got no error")
+	}
+	if tr.Out != first {
+		t.Fatal("a rejected Logger replaced Out")
+	}
+
+	second := &recordingLogger{}
+	if err := tr.SetOut(second); err != nil {
+		t.Fatalf("SetOut(valid logger): got error %v", err)
+	}
+	tr.Trace(0)
+	if len(first.lines) != 0 || len(second.lines) == 0 {
+		t.Errorf("got %d lines in the old Logger and %d in the new one, want only the new one written", len(first.lines), len(second.lines))
+	}
+}
+
+func TestShowSource(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowSource = true
+	_, _, line, _ := runtime.Caller(0)
+	tr.Trace(0, "shown")
+
+	want := fmt.Sprintf(` [%d: tr.Trace(0, "shown")] shown`, line+1)
+	if last := out.lines[len(out.lines)-1]; !strings.Contains(last, "TestShowSource()"+want) {
+		t.Errorf("got line %q, want it to contain %q", last, want)
+	}
+
+	// Files that cannot be read are shown without a snippet.
+	tr.TraceFrames(functionFrames("main.work", "main.main"), "missing")
+	if last := out.lines[len(out.lines)-1]; strings.Contains(last, "[") {
+		t.Errorf("got line %q, want no snippet for a missing file", last)
+	}
+}
+
+func TestArmAfter(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ArmAfter("main.handle", 3)
+	frames := functionFrames("main.handle", "main.main")
+
+	tr.TraceFrames(functionFrames("main.other", "main.main"))
+	tr.TraceFrames(frames, "call 1")
+	tr.TraceFrames(frames, "call 2")
+	if len(out.lines) != 0 {
+		t.Fatalf("got output before the threshold: %q", out.lines)
+	}
+	tr.TraceFrames(frames, "call 3")
+	if len(out.lines) == 0 || !strings.HasSuffix(out.lines[len(out.lines)-1], "main.handle() call 3") {
+		t.Fatalf("got output %q after the threshold, want it to end with call 3", out.lines)
+	}
+	tr.TraceFrames(functionFrames("main.other", "main.main"), "later")
+	if !strings.HasSuffix(out.lines[len(out.lines)-1], "main.other() later") {
+		t.Errorf("got output %q, want other functions traced once armed", out.lines)
+	}
+}
+
+func TestSetGlobal(t *testing.T) {
+	defer SetGlobal(GetGlobal())
+	first, second := &recordingLogger{}, &recordingLogger{}
+	tracers := []*Tracer{newTestTracer(first), newTestTracer(second)}
+	SetGlobal(tracers[0])
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				Trace("racing")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		SetGlobal(tracers[i%2])
+	}
+	wg.Wait()
+
+	if GetGlobal() != tracers[1] {
+		t.Error("GetGlobal() did not return the last Tracer set")
+	}
+	first.mutex.Lock()
+	defer first.mutex.Unlock()
+	second.mutex.Lock()
+	defer second.mutex.Unlock()
+	if len(first.lines)+len(second.lines) == 0 {
+		t.Error("got no output from either Tracer")
+	}
+}
+
+func TestSection(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	frames := functionFrames("main.work", "main.main")
+	last := func() string { return out.lines[len(out.lines)-1] }
+
+	tr.TraceFrames(frames, "outside")
+	if got, want := last(), "  main.work() outside"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	closeParse := tr.Section("parse")
+	if got, want := last(), "[parse]"; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+	tr.TraceFrames(frames, "parsing")
+	if got, want := last(), "    main.work() parsing"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	closeValidate := tr.Section("validate")
+	if got, want := last(), "  [validate]"; got != want {
+		t.Errorf("got nested header %q, want %q", got, want)
+	}
+	tr.TraceFrames(frames, "validating")
+	if got, want := last(), "      main.work() validating"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	closeValidate()
+	tr.TraceFrames(frames, "parsed")
+	if got, want := last(), "    main.work() parsed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	closeParse()
+	closeParse()
+	tr.TraceFrames(frames, "done")
+	if got, want := last(), "  main.work() done"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHintWhenOff(t *testing.T) {
+	defer func(saved Logger) { fallbackOut = saved }(fallbackOut)
+	defer func(saved bool) { HintWhenOff = saved }(HintWhenOff)
+	defer SetGlobal(GetGlobal())
+	hints := &recordingLogger{}
+	fallbackOut = hints
+	tr := newTestTracer(&recordingLogger{})
+	tr.On = false
+	SetGlobal(tr)
+
+	HintWhenOff = false
+	atomic.StoreInt32(&hintedOff, 0)
+	Trace("suppressed")
+	if len(hints.lines) != 0 {
+		t.Fatalf("got hints %q, want none while suppressed", hints.lines)
+	}
+
+	HintWhenOff = true
+	Trace("first")
+	Trace("second")
+	if len(hints.lines) != 1 || !strings.Contains(hints.lines[0], "tracing is off") {
+		t.Errorf("got hints %q, want a single hint", hints.lines)
+	}
+
+	// Tracing turned off on purpose is not worth a hint.
+	hints.lines = nil
+	atomic.StoreInt32(&hintedOff, 0)
+	On(true)
+	Trace("on")
+	On(false)
+	Trace("off")
+	if len(hints.lines) != 0 {
+		t.Errorf("got hints %q, want none after On() was called", hints.lines)
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+	if got, want := tr.StatusTable(), "G  FUNCTION  LOCATION  AGE"; got != want {
+		t.Errorf("got empty table %q, want %q", got, want)
+	}
+
+	ids := make([]int, 3)
+	for idx, function := range []string{"main.parse", "main.validate", "main.emit"} {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func(idx int, function string) {
+			defer wg.Done()
+			ids[idx] = GoroutineID()
+			tr.TraceFrames(functionFrames(function, "main.main"))
+		}(idx, function)
+		wg.Wait()
+	}
+
+	rows := strings.Split(tr.StatusTable(), "\n")
+	if len(rows) != 4 || !strings.HasPrefix(rows[0], "G ") {
+		t.Fatalf("got table %q, want a header and 3 rows", rows)
+	}
+	want := map[int]string{ids[0]: "main.parse() main.go:2 3.0s", ids[1]: "main.validate() main.go:2 2.0s", ids[2]: "main.emit() main.go:2 1.0s"}
+	previousID := 0
+	for _, row := range rows[1:] {
+		fields := strings.Fields(row)
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id <= previousID {
+			t.Errorf("got row %q, want rows sorted by goroutine ID", row)
+		}
+		previousID = id
+		if got := strings.Join(fields[1:], " "); got != want[id] {
+			t.Errorf("got row %q for goroutine %d, want %q", got, id, want[id])
+		}
+	}
+}
+
+func TestModulePrefix(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	tr.ModulePrefix = "example.com/app"
+	tr.TraceFrames(functionFrames("example.com/lib.Do", "example.com/app/server.handle", "example.com/app.main"))
+
+	want := []string{
+		"*example.com/app.main()",
+		" *example.com/app/server.handle()",
+		"    example.com/lib.Do()",
+	}
+	if got := out.lines[len(out.lines)-3:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.StatsInterval = 3 * time.Second
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+	frames := functionFrames("main.work", "main.main")
+
+	for idx := 0; idx < 3; idx++ {
+		tr.TraceFrames(frames, "call %d", idx)
+	}
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, "[trace]") {
+			t.Fatalf("got summary %q before the interval elapsed", line)
+		}
+	}
+	linesBefore := len(out.lines)
+	tr.TraceFrames(frames, "call 3")
+	summary := out.lines[linesBefore]
+	want := fmt.Sprintf("[trace] %d lines, %.0f/s, 1 goroutines", linesBefore, float64(linesBefore)/3)
+	if summary != want {
+		t.Errorf("got summary %q, want %q", summary, want)
+	}
+}
+
+func TestSwitchOut(t *testing.T) {
+	out, switchOut := &recordingLogger{}, &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.SwitchOut = switchOut
+	tr.OnGoroutineSwitchPrintStackHistory = true
+	tr.Trace(0, "first")
+	done := make(chan struct{})
+	go func() {
+		tr.Trace(0, "other")
+		close(done)
+	}()
+	<-done
+	tr.Trace(0, "back")
+
+	for _, line := range out.lines {
+		if strings.Contains(line, "goroutine switched") {
+			t.Errorf("got banner %q in Out", line)
+		}
+	}
+	var banners int
+	for _, line := range switchOut.lines {
+		if strings.Contains(line, "goroutine switched") {
+			banners++
+		} else if strings.Contains(line, "other") || strings.HasSuffix(line, "back") {
+			t.Errorf("got new frame %q in SwitchOut", line)
+		}
+	}
+	if banners == 0 {
+		t.Errorf("got no banner in SwitchOut: %q", switchOut.lines)
+	}
+	if last := out.lines[len(out.lines)-1]; !strings.HasSuffix(last, "back") {
+		t.Errorf("got last line %q in Out, want the frame traced last", last)
+	}
+}
+
+func TestLinesEmitted(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.On = false
+	tr.Trace(0, "off")
+	if got := tr.Stats().Traces; got != 0 || tr.LinesEmitted() != 0 {
+		t.Errorf("got %d traces and %d lines while off, want none", got, tr.LinesEmitted())
+	}
+
+	tr.On = true
+	tr.Predicate = func(int) bool { return false }
+	tr.Trace(0, "filtered")
+	tr.Predicate = nil
+	tr.Trace(0, "on")
+	tr.Trace(0, "on again")
+	if got := tr.Stats().Traces; got != 2 {
+		t.Errorf("got %d traces, want 2", got)
+	}
+	if got := tr.LinesEmitted(); got != len(out.lines) {
+		t.Errorf("got %d lines emitted, want %d", got, len(out.lines))
+	}
+}
+
+func TestFrameEqual(t *testing.T) {
+	for _, tc := range []struct {
+		label      string
+		frameEqual func(a, b *FrameInfo) bool
+		wantLines  int
+	}{
+		{"default", nil, 2},
+		{"same function", func(a, b *FrameInfo) bool { return a.Function == b.Function }, 1},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.FrameEqual = tc.frameEqual
+		tr.TraceFrames(functionFrames("main.helper", "main.work", "main.main"))
+		moved := functionFrames("main.helper", "main.work", "main.main")
+		moved[1].Line = 10
+		linesBefore := len(out.lines)
+		tr.TraceFrames(moved)
+
+		if got := len(out.lines) - linesBefore; got != tc.wantLines {
+			t.Errorf("[%s] got %d new lines %q, want %d", tc.label, got, out.lines[linesBefore:], tc.wantLines)
+		}
+	}
+}
+
+func TestFormatFrame(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.OmitTime = true
+	tr.SourceLength = 24
+	frame := &FrameInfo{
+		Frame:        runtime.Frame{Function: "main.work", File: "main.go", Line: 42, PC: 7},
+		TimeRecorded: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	for _, tc := range []struct {
+		level   int
+		isNew   bool
+		message string
+		want    string
+	}{
+		{0, true, "hello 100%", "main.go:42    p7 g17 + main.work() hello 100%"},
+		{2, false, "", "main.go:42    p7 g17       main.work()"},
+		{-1, true, "", "main.go:42    p7 g17 + main.work()"},
+	} {
+		if got := tr.FormatFrame(17, tc.level, frame, tc.isNew, tc.message); got != tc.want {
+			t.Errorf("FormatFrame(level %d, isNew %t): got %q, want %q", tc.level, tc.isNew, got, tc.want)
+		}
+	}
+}
+
+func TestFormatFrameHasNoSideEffects(t *testing.T) {
+	var starts int
+	tr := &Tracer{
+		SourceLength:   24,
+		OmitTime:       true,
+		PrintBuildInfo: true,
+		OnStart:        func(*Tracer) { starts++ },
+	}
+	frame := &FrameInfo{Frame: runtime.Frame{Function: "main.work", File: "main.go", Line: 42, PC: 7}}
+	if got, want := tr.FormatFrame(17, 0, frame, true, "hello"), "main.go:42    p7 g17 + main.work() hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if starts != 0 {
+		t.Errorf("got OnStart called %d times by FormatFrame on an inactive Tracer, want 0", starts)
+	}
+
+	out := &recordingLogger{}
+	tr.Out = out
+	tr.FormatFrame(17, 0, frame, true, "hello")
+	if len(out.lines) != 0 || starts != 0 {
+		t.Errorf("got lines %q and %d calls to OnStart from FormatFrame, want none", out.lines, starts)
+	}
+}
+
+func TestSuppressIdenticalStacks(t *testing.T) {
+	for _, tc := range []struct {
+		suppress  bool
+		wantLines int
+	}{
+		{false, 1},
+		{true, 0},
+	} {
+		out := &recordingLogger{}
+		tr := newTestTracer(out)
+		tr.SuppressIdenticalStacks = tc.suppress
+		tr.TraceFrames(functionFrames("main.work", "main.main"), "first")
+		linesBefore := len(out.lines)
+		tr.TraceFrames(functionFrames("main.work", "main.main"), "second")
+
+		if got := len(out.lines) - linesBefore; got != tc.wantLines {
+			t.Errorf("SuppressIdenticalStacks = %t: got %d new lines %q, want %d", tc.suppress, got, out.lines[linesBefore:], tc.wantLines)
+		}
+	}
+}
+
+func TestActiveGoroutines(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+
+	ids := make([]int, 3)
+	for idx := range ids {
+		done := make(chan struct{})
+		go func(idx int) {
+			ids[idx] = GoroutineID()
+			tr.TraceFrames(functionFrames("main.work", "main.main"))
+			close(done)
+		}(idx)
+		<-done
+	}
+
+	// The goroutines traced at 0s, 1s and 2s, and it is now 3s.
+	if got, want := tr.ActiveGoroutines(2*time.Second), ids[1:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got active goroutines %v, want %v", got, want)
+	}
+
+	// An identical stack keeps the time recorded for its top frame,
+	// but the goroutine is still active.
+	tr.SuppressIdenticalStacks = true
+	for i := 0; i < 5; i++ {
+		tr.TraceFrames(functionFrames("main.poll", "main.main"))
+	}
+	if got := tr.ActiveGoroutines(2 * time.Second); len(got) != 1 || got[0] != GoroutineID() {
+		t.Errorf("got active goroutines %v, want only %d, which keeps tracing", got, GoroutineID())
+	}
+}
+
+func TestTraceErrChain(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	root := errors.New("connection refused")
+	joined := errors.Join(fmt.Errorf("dial: %w", root), errors.New("timeout"))
+	err := fmt.Errorf("fetch: %w", joined)
+	tr.TraceErrChain(err, "loading")
+
+	chain := out.lines[len(out.lines)-4:]
+	top := out.lines[len(out.lines)-5]
+	if !strings.Contains(top, "TestTraceErrChain() loading: fetch: dial: connection refused") {
+		t.Errorf("got top line %q, want the traced error", top)
+	}
+	column := strings.Index(top, "trace.TestTraceErrChain") + 2
+	want := []string{
+		"dial: connection refused\ntimeout",
+		"  dial: connection refused",
+		"    connection refused",
+		"  timeout",
+	}
+	for idx, line := range chain {
+		if got := line[column:]; line[:column] != strings.Repeat(" ", column) || got != want[idx] {
+			t.Errorf("got chain line %d %q, want %q indented by %d", idx, line, want[idx], column)
+		}
+	}
+
+	tr.On = false
+	counting := &countingError{}
+	tr.TraceErrChain(errors.Join(counting))
+	if counting.calls != 0 {
+		t.Errorf("tracing off: Error() called %d times, want 0", counting.calls)
+	}
+}
+
+func TestMaxDumpGoroutines(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), time.Second)
+	tr.MaxDumpGoroutines = 3
+	ids := make([]int, 10)
+	for idx := range ids {
+		done := make(chan struct{})
+		go func(idx int) {
+			ids[idx] = GoroutineID()
+			tr.TraceFrames(functionFrames("main.work", "main.main"))
+			close(done)
+		}(idx)
+		<-done
+	}
+
+	out := &recordingLogger{}
+	tr.PrintTo(out)
+	var dumped []string
+	for _, line := range out.lines {
+		if strings.Contains(line, " goroutine ") && strings.HasPrefix(line, "-") {
+			dumped = append(dumped, strings.Fields(line)[2])
+		}
+	}
+	if want := []string{strconv.Itoa(ids[7]), strconv.Itoa(ids[8]), strconv.Itoa(ids[9])}; fmt.Sprint(dumped) != fmt.Sprint(want) {
+		t.Errorf("got goroutines %v dumped, want the most recent %v", dumped, want)
+	}
+	if last, want := out.lines[len(out.lines)-1], "... and 7 more goroutines"; last != want {
+		t.Errorf("got footer %q, want %q", last, want)
+	}
+}
+
+func TestShowIdleTime(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowIdleTime = true
+	tr.ClockFn = FixedClock(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), 1600*time.Millisecond)
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+	done := make(chan struct{})
+	go func() {
+		tr.TraceFrames(functionFrames("main.other", "main.main"))
+		close(done)
+	}()
+	<-done
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+
+	var banners []string
+	for _, line := range out.lines {
+		if strings.Contains(line, "goroutine switched") {
+			banners = append(banners, line)
+		}
+	}
+	if len(banners) != 3 || strings.Contains(banners[1], "idle") {
+		t.Fatalf("got banners %q, want 3 and no idle time for a new goroutine", banners)
+	}
+	if want := fmt.Sprintf("-> %-3d (idle 3.2s) ", GoroutineID()); !strings.Contains(banners[2], want) {
+		t.Errorf("got banner %q, want it to contain %q", banners[2], want)
+	}
+
+	// An identical stack keeps the time recorded for its top frame,
+	// but the goroutine was not idle meanwhile.
+	tr.SuppressIdenticalStacks = true
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+	done = make(chan struct{})
+	go func() {
+		tr.TraceFrames(functionFrames("main.other", "main.main"))
+		close(done)
+	}()
+	<-done
+	out.lines = nil
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+	if want := fmt.Sprintf("-> %-3d (idle 3.2s) ", GoroutineID()); len(out.lines) == 0 || !strings.Contains(out.lines[0], want) {
+		t.Errorf("got lines %q, want a banner containing %q", out.lines, want)
+	}
+}
+
+func TestMessagesOnly(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	tr.MessagesOnly = true
+	tr.TraceFrames(functionFrames("main.parse", "main.run", "main.main"), "parsing")
+	tr.TraceFrames(functionFrames("main.emit", "main.main"), "emitting")
+	tr.TraceFrames(functionFrames("main.quiet", "main.main"))
+
+	var frames []string
+	for _, line := range out.lines {
+		if !strings.Contains(line, "goroutine switched") {
+			frames = append(frames, line)
+		}
+	}
+	want := []string{
+		"    main.parse() parsing",
+		"  main.emit() emitting",
+	}
+	if fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", frames, want)
+	}
+}
+
+func TestResetGoroutineTracking(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.Trace(0, "before")
+	tr.ResetGoroutineTracking()
+	linesBefore := len(out.lines)
+	done := make(chan struct{})
+	go func() {
+		tr.Trace(0, "handed off")
+		close(done)
+	}()
+	<-done
+
+	for _, line := range out.lines[linesBefore:] {
+		if strings.Contains(line, "goroutine switched") {
+			t.Errorf("got banner %q after ResetGoroutineTracking", line)
+		}
+	}
+	if len(out.lines) == linesBefore {
+		t.Error("got no output after ResetGoroutineTracking")
+	}
+	if goroutine := tr.Goroutines()[GoroutineID()]; goroutine == nil || len(goroutine.Frames) == 0 {
+		t.Error("ResetGoroutineTracking cleared the frames of the previous goroutine")
+	}
+}
+
+func TestLoggerFunc(t *testing.T) {
+	// events stands for a span recording events, such as that of an
+	// OpenTelemetry exporter.
+	var events []string
+	tr := newTestTracer(LoggerFunc(func(line string) { events = append(events, line) }))
+	tr.OmitTime = true
+	tr.Trace(0, "hello %d", 42)
+	tr.Out.Println("done", 1)
+
+	if len(events) < 2 || !strings.HasSuffix(events[len(events)-2], "TestLoggerFunc() hello 42") {
+		t.Errorf("got events %q, want the traced frame", events)
+	}
+	if got, want := events[len(events)-1], "done 1"; got != want {
+		t.Errorf("got event %q from Println, want %q", got, want)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.SequenceNumbers = true
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				tr.Trace(0, "call %d", i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	previous := 0
+	for _, line := range out.lines {
+		var sequence int
+		if _, err := fmt.Sscanf(line, "#%06d ", &sequence); err != nil || sequence != previous+1 {
+			t.Fatalf("got line %q after sequence number %d, want %d", line, previous, previous+1)
+		}
+		previous = sequence
+	}
+}
+
+func TestShowDirection(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.ShowDirection = true
+	// The trace in main.run after the return from main.parse is on
+	// another line than the call.
+	returned := functionFrames("main.run", "main.main")
+	returned[0].Line = 10
+	for _, tc := range []struct {
+		frames []*FrameInfo
+		want   string
+	}{
+		{functionFrames("main.run", "main.main"), "main.run() start"},
+		{functionFrames("main.parse", "main.run", "main.main"), "main.parse() ↓ start"},
+		{functionFrames("main.parse", "main.run", "main.main"), "main.parse() start"},
+		{returned, "main.run() ↑ start"},
+	} {
+		tr.TraceFrames(tc.frames, "start")
+		if last := out.lines[len(out.lines)-1]; !strings.HasSuffix(last, tc.want) {
+			t.Errorf("got line %q, want it to end with %q", last, tc.want)
+		}
+	}
+}
+
+func TestGoldenDump(t *testing.T) {
+	run := func() string {
+		tr := newTestTracer(&recordingLogger{})
+		tr.Trace(0, "main goroutine")
+		done := make(chan struct{})
+		go func() {
+			tr.Trace(0, "other goroutine")
+			close(done)
+		}()
+		<-done
+		var golden strings.Builder
+		tr.GoldenDump(&golden)
+		return golden.String()
+	}
+
+	first, second := run(), run()
+	if first != second {
+		t.Errorf("got different golden dumps:\n%s\nand:\n%s", first, second)
+	}
+	for _, want := range []string{
+		"goroutine 1\n",
+		"trace.TestGoldenDump.func1() trace_test.go:",
+		"goroutine 2\n",
+		"trace.TestGoldenDump.func1.1() trace_test.go:",
+		" other goroutine\n",
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("got golden dump:\n%s\nwant it to contain %q", first, want)
+		}
+	}
+}
+
+func TestPrintBuildInfo(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.PrintBuildInfo = true
+	tr.Trace(0, "first")
+	tr.Trace(0, "second")
+
+	var headers []string
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, "build: ") {
+			headers = append(headers, line)
+		}
+	}
+	if len(headers) != 1 || !strings.Contains(headers[0], "go="+runtime.Version()) {
+		t.Errorf("got headers %q, want one with the Go version %s", headers, runtime.Version())
+	}
+	if out.lines[0] != headers[0] {
+		t.Errorf("got first line %q, want the header", out.lines[0])
+	}
+}
+
+func TestTraceAtLevel(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	tr.Trace(0, "before")
+	for _, level := range []int{0, 1, 3} {
+		tr.TraceAtLevel(level, "at level %d", level)
+		want := fmt.Sprintf("%strace.TestTraceAtLevel() at level %d", strings.Repeat("  ", level), level)
+		if last := out.lines[len(out.lines)-1]; last != want {
+			t.Errorf("got line %q, want %q", last, want)
+		}
+	}
+}
+
+func TestRangeHistory(t *testing.T) {
+	tr := newTestTracer(&recordingLogger{})
+	for idx := 0; idx < 3; idx++ {
+		tr.Trace(0, "call %d", idx)
+	}
+	history := tr.Goroutines()[GoroutineID()].History
+
+	var all []string
+	tr.RangeHistory(GoroutineID(), func(line string) bool {
+		all = append(all, line)
+		return true
+	})
+	if fmt.Sprint(all) != fmt.Sprint(history) {
+		t.Errorf("got lines %q, want the History %q", all, history)
+	}
+
+	var searched []string
+	tr.RangeHistory(GoroutineID(), func(line string) bool {
+		searched = append(searched, line)
+		return !strings.HasSuffix(line, "call 1")
+	})
+	if len(searched) == 0 || len(searched) >= len(history) || !strings.HasSuffix(searched[len(searched)-1], "call 1") {
+		t.Errorf("got lines %q, want iteration to stop at call 1", searched)
+	}
+
+	tr.RangeHistory(-1, func(line string) bool {
+		t.Errorf("got line %q for an unknown goroutine", line)
+		return true
+	})
+}
+
+func TestSlowThreshold(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.SlowThreshold = 5 * time.Second
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	tr.ClockFn = func() time.Time { return now }
+	call := func(name string, duration time.Duration) {
+		done := tr.TraceEnter(name)
+		now = now.Add(duration)
+		done()
+	}
+
+	call("fast", time.Second)
+	if len(out.lines) != 0 {
+		t.Fatalf("got output %q for a fast call", out.lines)
+	}
+	call("slow", 10*time.Second)
+	var traced []string
+	for _, line := range out.lines {
+		if strings.Contains(line, "TestSlowThreshold.func2()") {
+			traced = append(traced, line[strings.Index(line, "func2()"):])
+		}
+	}
+	want := []string{"func2() enter slow", "func2() exit slow (10s)"}
+	if fmt.Sprint(traced) != fmt.Sprint(want) {
+		t.Errorf("got lines %q, want %q", traced, want)
+	}
+
+	// A slow call rejected by the Predicate prints neither its entry
+	// nor its exit.
+	out.lines = nil
+	tr.Predicate = func(goroutineID int) bool { return false }
+	call("filtered", 10*time.Second)
+	if len(out.lines) != 0 {
+		t.Errorf("got output %q for a call rejected by the Predicate", out.lines)
+	}
+}
+
+func TestFrameDecorator(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.FrameDecorator = func(line string, isNew bool, level int) string {
+		if isNew {
+			return fmt.Sprintf("[%d %s]", level, line)
+		}
+		return line
+	}
+	tr.ContextFrames = 1
+	tr.TraceFrames(functionFrames("main.work", "main.main"))
+	tr.TraceFrames(functionFrames("main.done", "main.main"))
+
+	last := out.lines[len(out.lines)-2:]
+	if strings.HasPrefix(last[0], "[") || !strings.HasSuffix(last[0], "main.main()") {
+		t.Errorf("got previous line %q, want it undecorated", last[0])
+	}
+	if !strings.HasPrefix(last[1], "[1 ") || !strings.HasSuffix(last[1], "+   main.done()]") {
+		t.Errorf("got new line %q, want it wrapped in brackets after the callout", last[1])
+	}
+}
+
+func TestLocationKeepsLine(t *testing.T) {
+	for _, tc := range []struct {
+		sourceLength int
+		want         string
+	}{
+		{40, "…/pkg/handler.go:12345  p123456789 g42%c"},
+		{10, "…:12345  p123456789 g42%c"},
+	} {
+		tr := &Tracer{SourceLength: tc.sourceLength, GoroutineIDWidth: 1}
+		frame := &FrameInfo{Frame: runtime.Frame{File: "/home/user/src/github.com/example/deeply/nested/pkg/handler.go", Line: 12345, PC: 123456789}}
+		if got := tr.location(frame, 42); got != tc.want {
+			t.Errorf("SourceLength %d: got %q, want %q", tc.sourceLength, got, tc.want)
+		}
+	}
+}
+
+func TestIndentLevel(t *testing.T) {
+	out := &recordingLogger{}
+	tr := newTestTracer(out)
+	tr.OmitTime = true
+	tr.SourceLength = 0
+	if got := tr.IndentLevel(GoroutineID()); got != 0 {
+		t.Errorf("got level %d before tracing, want 0", got)
+	}
+	tr.TraceFrames(functionFrames("main.work", "main.run", "main.main"))
+
+	level := tr.IndentLevel(GoroutineID())
+	if want := len(tr.Goroutines()[GoroutineID()].Frames); level != want {
+		t.Errorf("got level %d, want the %d recorded frames", level, want)
+	}
+	// The top frame is printed at the level below the depth.
+	if got, want := out.lines[len(out.lines)-1], tr.Indentation(level-1)+"main.work()"; got != want {
+		t.Errorf("got top line %q, want %q", got, want)
+	}
+	if got, want := tr.Indentation(level), strings.Repeat("  ", level); got != want {
+		t.Errorf("got indentation %q, want %q", got, want)
+	}
+}
+
+// functionFrames returns synthetic frames for the named functions,
+// with the top of the stack first.
+func functionFrames(functions ...string) []*FrameInfo {
+	frames := make([]*FrameInfo, len(functions))
+	for idx, function := range functions {
+		frames[idx] = &FrameInfo{
+			Frame: runtime.Frame{Function: function, File: "main.go", Line: len(functions) - idx},
+		}
+	}
+	return frames
+}
+
+func TestGoroutineIDWidth(t *testing.T) {
+	frame := &FrameInfo{Frame: runtime.Frame{File: "a.go", Line: 3, PC: 7}}
+	tr := &Tracer{SourceLength: 40, GoroutineIDWidth: 5}
+	small, large := tr.location(frame, 7), tr.location(frame, 12345)
+	if want := "  p7 g7    %c"; !strings.HasSuffix(small, want) {
+		t.Errorf("small id: got %q, want suffix %q", small, want)
+	}
+	if want := "  p7 g12345%c"; !strings.HasSuffix(large, want) {
+		t.Errorf("large id: got %q, want suffix %q", large, want)
+	}
+	if strings.Index(small, "a.go") != strings.Index(large, "a.go") {
+		t.Errorf("source columns misaligned:\n%q\n%q", small, large)
+	}
+}
+
+// recordingLogger is a Logger that stores every line written to it.
+type recordingLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (rl *recordingLogger) Printf(format string, v ...interface{}) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.lines = append(rl.lines, fmt.Sprintf(format, v...))
+}
+
+func (rl *recordingLogger) Println(v ...interface{}) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.lines = append(rl.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// newTestTracer returns an active Tracer writing to `out`.
+func newTestTracer(out Logger) *Tracer {
+	return &Tracer{
+		On:           true,
+		Out:          out,
+		Capacity:     100,
+		SourceLength: 40,
+	}
+}